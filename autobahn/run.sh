@@ -0,0 +1,37 @@
+#!/bin/sh
+# Autobahn Testsuiteのfuzzingclientで、このサーバーのRFC 6455への準拠を検証する
+# 12.*と13.*はpermessage-deflateのテストなので除外している
+# 結果はautobahn/reports/index.htmlに出力される
+set -eu
+
+cd "$(dirname "$0")/.."
+
+go build -o autobahn/server .
+# 7.9.*は送信してはいけないステータスコードのcloseフレームに1002で応じることを求めるので、-strictで起動する
+# 一方的なpong(2.7〜2.9)は-strictでも警告するだけなので、これらのケースには影響しない
+# 9.*では大きなメッセージを大量にやり取りするので、サーバーのログはファイルに書き出す
+# 前回の結果を判定に使わないよう、レポートは実行のたびに作り直す
+rm -rf autobahn/reports
+mkdir -p autobahn/reports
+./autobahn/server -strict >autobahn/reports/server.log 2>&1 &
+pid=$!
+trap 'kill $pid' EXIT
+sleep 1
+
+docker run --rm \
+	--network host \
+	-v "$PWD/autobahn:/config" \
+	-v "$PWD/autobahn/reports:/reports" \
+	crossbario/autobahn-testsuite \
+	wstest -m fuzzingclient -s /config/fuzzingclient.json
+
+# レポートがなければ、テストケースが実行されていないので失敗とする
+if [ ! -s autobahn/reports/index.json ]; then
+	echo "autobahn/reports/index.json was not generated" >&2
+	exit 1
+fi
+# いずれかのテストケースがFAILEDであれば失敗とする
+if grep -Eq '"behavior(Close)?": *"FAILED"' autobahn/reports/index.json; then
+	echo "some Autobahn test cases FAILED; see autobahn/reports/index.html" >&2
+	exit 1
+fi
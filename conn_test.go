@@ -0,0 +1,1065 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// testMaskingKey はテストでクライアントのフレームをマスクするキー
+var testMaskingKey = [4]byte{0x37, 0xfa, 0x21, 0x3d}
+
+// clientFrame はクライアントが送るマスクされたフレームを作る
+func clientFrame(fin bool, op opcode, payload []byte) []byte {
+	b0 := byte(op)
+	if fin {
+		b0 |= 0x80
+	}
+	b := []byte{b0}
+	switch n := len(payload); {
+	case n < 126:
+		b = append(b, 0x80|byte(n))
+	case n <= 0xFFFF:
+		b = append(b, 0x80|126, byte(n>>8), byte(n))
+	default:
+		b = append(b, 0x80|127, 0, 0, 0, 0, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+	}
+	b = append(b, testMaskingKey[:]...)
+	for i, c := range payload {
+		b = append(b, c^testMaskingKey[i%4])
+	}
+	return b
+}
+
+// clientClose はクライアントが送るcloseフレームを作る
+func clientClose(code int, reason string) []byte {
+	return clientFrame(true, opClose, append([]byte{byte(code >> 8), byte(code)}, reason...))
+}
+
+// serverFrame はサーバーが書き込んだ(マスクされていない)フレーム
+type serverFrame struct {
+	fin     bool
+	opcode  opcode
+	payload []byte
+}
+
+// closeCode はcloseフレームのステータスコードを返す(ペイロードがない場合は1005)
+func (f serverFrame) closeCode() int {
+	if len(f.payload) < 2 {
+		return 1005
+	}
+	return int(f.payload[0])<<8 | int(f.payload[1])
+}
+
+// readServerFrame はサーバーが書き込んだフレームを1つ読み込む
+// readFrameHeaderはマスクされていないフレームを受け付けないので、テスト用に別に解析する
+func readServerFrame(r io.Reader) (serverFrame, error) {
+	var h [2]byte
+	if _, err := io.ReadFull(r, h[:]); err != nil {
+		return serverFrame{}, err
+	}
+	f := serverFrame{fin: h[0]&0x80 != 0, opcode: opcode(h[0] & 0x0F)}
+	if h[1]&0x80 != 0 {
+		return f, errors.New("server frame must not be masked")
+	}
+	n := int(h[1] & 0x7F)
+	switch n {
+	case 126, 127:
+		ext := make([]byte, 2)
+		if n == 127 {
+			ext = make([]byte, 8)
+		}
+		if _, err := io.ReadFull(r, ext); err != nil {
+			return f, err
+		}
+		n = 0
+		for _, c := range ext {
+			n = n<<8 | int(c)
+		}
+	}
+	f.payload = make([]byte, n)
+	_, err := io.ReadFull(r, f.payload)
+	return f, err
+}
+
+// parseServerFrames はサーバーが書き込んだフレームを順に取り出す
+func parseServerFrames(t *testing.T, b []byte) []serverFrame {
+	t.Helper()
+	var frames []serverFrame
+	r := bytes.NewReader(b)
+	for r.Len() > 0 {
+		f, err := readServerFrame(r)
+		if err != nil {
+			t.Fatalf("parse server frame: %v", err)
+		}
+		frames = append(frames, f)
+	}
+	return frames
+}
+
+// newTestConn はinputを受信し、書き込んだフレームをoutに溜めるconnを作る
+// 通信路はデッドラインに対応していないので、タイムアウトは発生しない
+func newTestConn(input ...[]byte) (*conn, *bytes.Buffer) {
+	out := &bytes.Buffer{}
+	rw := struct {
+		io.Reader
+		io.Writer
+	}{bytes.NewReader(bytes.Join(input, nil)), out}
+	return newConn(rw, bufio.NewReader(rw), bufio.NewWriter(rw)), out
+}
+
+func TestUnmaskedFrameRejected(t *testing.T) {
+	// マスクされていないテキストフレーム"hi"
+	c, _ := newTestConn([]byte{0x81, 0x02, 'h', 'i'})
+	_, _, err := c.readMessage()
+	var fe *frameError
+	if !errors.As(err, &fe) || fe.code != 1002 {
+		t.Fatalf("readMessage() error = %v, want frameError 1002", err)
+	}
+}
+
+func TestInvalidUTF8TextRejected(t *testing.T) {
+	tests := []struct {
+		name   string
+		frames [][]byte
+		want   int // 0の場合は受け付ける
+	}{
+		{"invalid text", [][]byte{clientFrame(true, opText, []byte{0xff, 0xfe})}, 1007},
+		{"invalid binary is fine", [][]byte{clientFrame(true, opBinary, []byte{0xff, 0xfe})}, 0},
+		{
+			// "€"(E2 82 AC)がフラグメントの境界で分かれていても、全体として正しければ受け付ける
+			"split code point",
+			[][]byte{clientFrame(false, opText, []byte{0xe2, 0x82}), clientFrame(true, opContinuation, []byte{0xac})},
+			0,
+		},
+		{
+			"truncated at end",
+			[][]byte{clientFrame(false, opText, []byte("ok")), clientFrame(true, opContinuation, []byte{0xe2, 0x82})},
+			1007,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := newTestConn(tt.frames...)
+			_, _, err := c.readMessage()
+			var fe *frameError
+			switch {
+			case tt.want == 0 && err != nil:
+				t.Fatalf("readMessage() error = %v, want nil", err)
+			case tt.want != 0 && (!errors.As(err, &fe) || fe.code != tt.want):
+				t.Fatalf("readMessage() error = %v, want frameError %d", err, tt.want)
+			}
+		})
+	}
+}
+
+// 送信してはいけないステータスコードのcloseフレームは、strictModeでは1002のエラー、
+// そうでなければ警告して1000を返信する
+func TestStrictModeInvalidCloseCode(t *testing.T) {
+	for _, strict := range []bool{false, true} {
+		c, out := newTestConn(clientClose(1005, ""))
+		c.strictMode = strict
+		var warnings []error
+		c.errorHandler = func(err error) { warnings = append(warnings, err) }
+
+		_, _, err := c.readMessage()
+
+		if strict {
+			var fe *frameError
+			if !errors.As(err, &fe) || fe.code != 1002 {
+				t.Errorf("strict: readMessage() error = %v, want frameError 1002", err)
+			}
+			if out.Len() != 0 {
+				t.Errorf("strict: wrote % x before the caller closed", out.Bytes())
+			}
+			continue
+		}
+
+		var ce *closeError
+		if !errors.As(err, &ce) || ce.code != 1005 {
+			t.Errorf("lenient: readMessage() error = %v, want closeError 1005", err)
+		}
+		if len(warnings) != 1 || !errors.Is(warnings[0], errInvalidCloseCode) {
+			t.Errorf("lenient: warnings = %v, want errInvalidCloseCode", warnings)
+		}
+		frames := parseServerFrames(t, out.Bytes())
+		if len(frames) != 1 || frames[0].opcode != opClose || frames[0].closeCode() != 1000 {
+			t.Errorf("lenient: reply = %+v, want a single close 1000", frames)
+		}
+	}
+}
+
+// 一方的なpongは仕様で認められているので、strictModeでも警告するだけで接続を続ける
+func TestUnsolicitedPongAllowed(t *testing.T) {
+	for _, strict := range []bool{false, true} {
+		c, _ := newTestConn(clientFrame(true, opPong, []byte("hb")), clientFrame(true, opText, []byte("hello")))
+		c.strictMode = strict
+		var warnings []error
+		c.errorHandler = func(err error) { warnings = append(warnings, err) }
+
+		op, payload, err := c.readMessage()
+		if err != nil || op != opText || string(payload) != "hello" {
+			t.Errorf("strict=%v: readMessage() = %v, %q, %v; want text \"hello\"", strict, op, payload, err)
+		}
+		if len(warnings) != 1 || !errors.Is(warnings[0], errUnsolicitedPong) {
+			t.Errorf("strict=%v: warnings = %v, want errUnsolicitedPong", strict, warnings)
+		}
+	}
+}
+
+func TestCloseWithError(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        error
+		wantCode   int // 0の場合はcloseフレームを送らない
+		wantReason string
+	}{
+		{"nil", nil, 1000, ""},
+		{"frameError", &frameError{code: 1009, reason: "message too big"}, 1009, "message too big"},
+		{"wrapped frameError", fmt.Errorf("read: %w", &frameError{code: 1002, reason: "bad frame"}), 1002, "bad frame"},
+		{"closeError", &closeError{code: 1000}, 0, ""},
+		{"canceled", context.Canceled, 1001, "going away"},
+		{"other", errors.New("boom"), 1011, "boom"},
+		{"long reason", errors.New(strings.Repeat("あ", 50)), 1011, strings.Repeat("あ", 41)},
+		{"invalid UTF-8 reason", errors.New("bad\xff"), 1011, "bad�"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, out := newTestConn()
+			if err := c.closeWithError(tt.err); err != nil {
+				t.Fatalf("closeWithError() = %v, want nil", err)
+			}
+			frames := parseServerFrames(t, out.Bytes())
+			if tt.wantCode == 0 {
+				if len(frames) != 0 {
+					t.Fatalf("wrote %+v, want nothing", frames)
+				}
+				return
+			}
+			if len(frames) != 1 || frames[0].opcode != opClose {
+				t.Fatalf("wrote %+v, want a single close frame", frames)
+			}
+			if got := frames[0].closeCode(); got != tt.wantCode {
+				t.Errorf("code = %d, want %d", got, tt.wantCode)
+			}
+			if got := string(frames[0].payload[2:]); got != tt.wantReason {
+				t.Errorf("reason = %q, want %q", got, tt.wantReason)
+			}
+		})
+	}
+}
+
+// フラグメント化されたメッセージの途中に、新しいメッセージのデータフレームが来た場合はプロトコル違反
+func TestDataFrameDuringFragmentedMessage(t *testing.T) {
+	for _, op := range []opcode{opText, opBinary} {
+		t.Run(op.String(), func(t *testing.T) {
+			c, _ := newTestConn(
+				clientFrame(false, opText, []byte("frag")),
+				clientFrame(true, op, []byte("new")),
+			)
+			_, _, err := c.readMessage()
+			var fe *frameError
+			if !errors.As(err, &fe) || fe.code != 1002 {
+				t.Fatalf("readMessage() error = %v, want frameError 1002", err)
+			}
+		})
+	}
+}
+
+// フラグメントの間に届いたcloseフレームには返信し、組み立て中のメッセージは捨てる
+func TestCloseBetweenFragments(t *testing.T) {
+	c, out := newTestConn(
+		clientFrame(false, opText, []byte("partial")),
+		clientClose(1001, "bye"),
+	)
+	_, _, err := c.readMessage()
+
+	var ce *closeError
+	if !errors.As(err, &ce) || ce.code != 1001 || ce.text != "bye" {
+		t.Fatalf("readMessage() error = %v, want closeError 1001 \"bye\"", err)
+	}
+	frames := parseServerFrames(t, out.Bytes())
+	if len(frames) != 1 || frames[0].opcode != opClose || frames[0].closeCode() != 1001 {
+		t.Errorf("reply = %+v, want a single close 1001", frames)
+	}
+	if c.fragmenting || len(c.message) != 0 || c.fragments != 0 {
+		t.Errorf("partial message kept: fragmenting=%v message=%q fragments=%d", c.fragmenting, c.message, c.fragments)
+	}
+}
+
+// メッセージの途中でないのに届いたcontinuationフレームはプロトコル違反
+func TestLeadingContinuationRejected(t *testing.T) {
+	for _, fin := range []bool{false, true} {
+		c, _ := newTestConn(clientFrame(fin, opContinuation, []byte("orphan")))
+		_, _, err := c.readMessage()
+		var fe *frameError
+		if !errors.As(err, &fe) || fe.code != 1002 {
+			t.Errorf("fin=%v: readMessage() error = %v, want frameError 1002", fin, err)
+		}
+	}
+}
+
+// 読み込みのバッファサイズによるreadMessageのスループットの違いを、ループバックのTCP接続で測る
+// バッファが大きいほどシステムコールの回数が減るが、コネクションごとのメモリは増える
+func BenchmarkReadMessage(b *testing.B) {
+	for _, msgSize := range []int{128, 16 << 10, 256 << 10} {
+		for _, bufSize := range []int{4 << 10, 64 << 10} {
+			b.Run(fmt.Sprintf("msg=%d/buf=%d", msgSize, bufSize), func(b *testing.B) {
+				ln, err := net.Listen("tcp", "127.0.0.1:0")
+				if err != nil {
+					b.Fatal(err)
+				}
+				defer ln.Close()
+				client, err := net.Dial("tcp", ln.Addr().String())
+				if err != nil {
+					b.Fatal(err)
+				}
+				defer client.Close()
+				nc, err := ln.Accept()
+				if err != nil {
+					b.Fatal(err)
+				}
+				defer nc.Close()
+
+				// 送信側はまとめて書き込み続け、受信側が読み込みを待たされないようにする
+				frame := clientFrame(true, opBinary, make([]byte, msgSize))
+				batch := bytes.Repeat(frame, max(1, (1<<20)/len(frame)))
+				go func() {
+					for {
+						if _, err := client.Write(batch); err != nil {
+							return
+						}
+					}
+				}()
+
+				c := newConn(nc, bufio.NewReaderSize(nc, bufSize), bufio.NewWriter(nc))
+				b.SetBytes(int64(msgSize))
+				b.ReportAllocs()
+				for b.Loop() {
+					if _, _, err := c.readMessage(); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
+
+// closeを送った後の読み捨てでは、宣言されたペイロード長の分のバッファを確保しない
+func TestCloseDrainDiscardsPayload(t *testing.T) {
+	t.Run("huge declared length", func(t *testing.T) {
+		// 1TiBのペイロードを宣言するだけのヘッダー
+		huge := maskedHeader(127, 0, 0, 0x01, 0, 0, 0, 0, 0)
+		c, out := newTestConn(clientFrame(true, opText, []byte{0xff}), huge)
+		c.closeGracePeriod = time.Second
+
+		err := c.run(func(opcode, []byte) error { return nil })
+		var fe *frameError
+		if !errors.As(err, &fe) || fe.code != 1007 {
+			t.Fatalf("run() error = %v, want frameError 1007", err)
+		}
+		frames := parseServerFrames(t, out.Bytes())
+		if len(frames) != 1 || frames[0].closeCode() != 1007 {
+			t.Errorf("wrote %+v, want a single close 1007", frames)
+		}
+	})
+
+	t.Run("data before close", func(t *testing.T) {
+		input := [][]byte{
+			clientFrame(true, opText, []byte{0xff}),
+			clientFrame(true, opBinary, make([]byte, 70000)),
+			clientClose(1000, ""),
+		}
+		c, _ := newTestConn(input...)
+		c.closeGracePeriod = time.Second
+		var warnings []error
+		c.errorHandler = func(err error) { warnings = append(warnings, err) }
+
+		c.run(func(opcode, []byte) error { return nil })
+		if want := int64(len(bytes.Join(input, nil))); c.bytesRead.Load() != want {
+			t.Errorf("bytesRead = %d, want %d", c.bytesRead.Load(), want)
+		}
+		if len(warnings) != 0 {
+			t.Errorf("warnings = %v, want none", warnings)
+		}
+	})
+}
+
+// newPipeConn はnet.Pipeの一方の端を通信路にしたconnと、相手側の端を返す
+// net.Pipeはバッファを持たないので、相手が読み込まなければ書き込みはブロックする
+func newPipeConn(t testing.TB) (*conn, net.Conn) {
+	t.Helper()
+	nc, peer := net.Pipe()
+	t.Cleanup(func() {
+		nc.Close()
+		peer.Close()
+	})
+	return newConn(nc, bufio.NewReader(nc), bufio.NewWriter(nc)), peer
+}
+
+func TestWriteMessageTimeout(t *testing.T) {
+	t.Run("non-reading peer", func(t *testing.T) {
+		c, _ := newPipeConn(t)
+		start := time.Now()
+		err := c.writeMessageTimeout(opText, []byte("hello"), 50*time.Millisecond)
+		var ne net.Error
+		if !errors.As(err, &ne) || !ne.Timeout() {
+			t.Fatalf("writeMessageTimeout() error = %v, want a timeout net.Error", err)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("writeMessageTimeout() returned after %v, want about 50ms", elapsed)
+		}
+		// 途中で失敗した書き込みの後はフレームの境界が分からないので、コネクションを終了する
+		select {
+		case <-c.ctx.Done():
+		default:
+			t.Error("connection context not canceled after the write timed out")
+		}
+	})
+
+	t.Run("deadline cleared afterwards", func(t *testing.T) {
+		c, peer := newPipeConn(t)
+		frames := make(chan serverFrame, 2)
+		go func() {
+			for {
+				f, err := readServerFrame(peer)
+				if err != nil {
+					return
+				}
+				frames <- f
+				// 2つ目のフレームは、1つ目のデッドラインを過ぎてから読み込む
+				time.Sleep(100 * time.Millisecond)
+			}
+		}()
+		if err := c.writeMessageTimeout(opText, []byte("first"), 50*time.Millisecond); err != nil {
+			t.Fatalf("writeMessageTimeout() error = %v", err)
+		}
+		<-frames
+		if err := c.writeFrame(opText, []byte("second")); err != nil {
+			t.Fatalf("writeFrame() after writeMessageTimeout error = %v, want nil", err)
+		}
+		if f := <-frames; string(f.payload) != "second" {
+			t.Errorf("second frame = %q, want \"second\"", f.payload)
+		}
+	})
+}
+
+// writeCounter は書き込みの回数を数えるio.Writer
+type writeCounter struct {
+	bytes.Buffer
+	writes int
+}
+
+func (w *writeCounter) Write(p []byte) (int, error) {
+	w.writes++
+	return w.Buffer.Write(p)
+}
+
+func TestWriteMessages(t *testing.T) {
+	msgs := []message{
+		{opText, []byte("snapshot")},
+		{opBinary, []byte{1, 2, 3}},
+		{opText, []byte("delta")},
+	}
+
+	t.Run("single flush", func(t *testing.T) {
+		w := &writeCounter{}
+		rw := struct {
+			io.Reader
+			io.Writer
+		}{bytes.NewReader(nil), w}
+		c := newConn(rw, bufio.NewReader(rw), bufio.NewWriter(rw))
+		if err := c.writeMessages(msgs); err != nil {
+			t.Fatalf("writeMessages() error = %v", err)
+		}
+		if w.writes != 1 {
+			t.Errorf("transport writes = %d, want 1", w.writes)
+		}
+		frames := parseServerFrames(t, w.Bytes())
+		if len(frames) != len(msgs) {
+			t.Fatalf("wrote %d frames, want %d", len(frames), len(msgs))
+		}
+		for i, f := range frames {
+			if f.opcode != msgs[i].op || !bytes.Equal(f.payload, msgs[i].payload) {
+				t.Errorf("frame %d = %v %q, want %v %q", i, f.opcode, f.payload, msgs[i].op, msgs[i].payload)
+			}
+		}
+	})
+
+	// 別のgoroutineがpingを送り続けていても、まとめて送ったメッセージの間には挟まらない
+	t.Run("no interleaved control frames", func(t *testing.T) {
+		c, peer := newPipeConn(t)
+		done := make(chan struct{})
+		go func() {
+			for {
+				select {
+				case <-done:
+					return
+				default:
+					c.writeControl(opPing, nil, time.Now().Add(time.Second))
+				}
+			}
+		}()
+		go func() {
+			c.writeMessages(msgs)
+			close(done)
+		}()
+
+		// 最初のデータフレームが届いてから、残りのメッセージが続けて届くことを確認する
+		var data []serverFrame
+		for len(data) < len(msgs) {
+			f, err := readServerFrame(peer)
+			if err != nil {
+				t.Fatalf("read frame: %v", err)
+			}
+			switch {
+			case f.opcode == opPing && len(data) > 0:
+				t.Fatalf("ping interleaved after %d of %d messages", len(data), len(msgs))
+			case f.opcode != opPing:
+				data = append(data, f)
+			}
+		}
+		<-done
+		// 送信中のpingを読み終えて、pingを送るgoroutineを終了させる
+		go io.Copy(io.Discard, peer)
+	})
+
+	t.Run("interceptor rejects before writing", func(t *testing.T) {
+		c, out := newTestConn()
+		errBinary := errors.New("binary not allowed")
+		c.frameInterceptor = func(dir frameDirection, h frameHeader, payload []byte) error {
+			if dir == frameWrite && h.opcode == opBinary {
+				return errBinary
+			}
+			return nil
+		}
+		if err := c.writeMessages(msgs); !errors.Is(err, errBinary) {
+			t.Fatalf("writeMessages() error = %v, want %v", err, errBinary)
+		}
+		if out.Len() != 0 {
+			t.Errorf("wrote % x, want nothing", out.Bytes())
+		}
+	})
+}
+
+// フラグメントの間に挟まったpingにはpongを返し、その後のcontinuationフレームで元のメッセージの組み立てを続ける
+func TestPingBetweenFragments(t *testing.T) {
+	c, out := newTestConn(
+		clientFrame(false, opText, []byte("Hel")),
+		clientFrame(true, opPing, []byte("are you there")),
+		clientFrame(true, opContinuation, []byte("lo")),
+	)
+	op, payload, err := c.readMessage()
+	if err != nil || op != opText || string(payload) != "Hello" {
+		t.Fatalf("readMessage() = %v, %q, %v; want text \"Hello\"", op, payload, err)
+	}
+	frames := parseServerFrames(t, out.Bytes())
+	if len(frames) != 1 || frames[0].opcode != opPong || string(frames[0].payload) != "are you there" {
+		t.Errorf("wrote %+v, want a single pong \"are you there\"", frames)
+	}
+}
+
+// net.Pipeの上でメッセージを送り、エコーされたメッセージを受け取るまでを測る
+// クライアントからのフレームは常にマスクされ、サーバーからのフレームはマスクしない
+// permessage-deflateには対応していないので、圧縮ありの場合は測らない
+func BenchmarkEcho(b *testing.B) {
+	for _, size := range []int{64, 4 << 10, 1 << 20} {
+		b.Run(fmt.Sprintf("size=%d", size), func(b *testing.B) {
+			c, peer := newPipeConn(b)
+			go c.run(func(op opcode, payload []byte) error {
+				return c.writeFrame(op, payload)
+			})
+
+			frame := clientFrame(true, opBinary, make([]byte, size))
+			reply := make([]byte, frameHeaderLen(size)+size)
+			b.SetBytes(int64(size))
+			b.ReportAllocs()
+			for b.Loop() {
+				if _, err := peer.Write(frame); err != nil {
+					b.Fatal(err)
+				}
+				if _, err := io.ReadFull(peer, reply); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "msgs/s")
+		})
+	}
+}
+
+// halfClosedTransport は相手が読み込みを止めた(受信側を閉じた)通信路
+// limitバイトまでは書き込めるが、それ以降の書き込みはsyscall.EPIPEで失敗する
+// 読み込みはCloseされるまでブロックする
+type halfClosedTransport struct {
+	pr      *io.PipeReader
+	limit   int
+	written int
+}
+
+func (t *halfClosedTransport) Read(p []byte) (int, error) { return t.pr.Read(p) }
+
+func (t *halfClosedTransport) Write(p []byte) (int, error) {
+	n := min(len(p), t.limit-t.written)
+	t.written += n
+	if n < len(p) {
+		return n, syscall.EPIPE
+	}
+	return n, nil
+}
+
+func (t *halfClosedTransport) Close() error { return t.pr.Close() }
+
+// 書き込みが途中で失敗した場合は、フレームを待ってブロックしている読み込みも終わらせ、コンテキストをキャンセルする
+func TestWriteFailureUnblocksReader(t *testing.T) {
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	tr := &halfClosedTransport{pr: pr, limit: 100}
+	c := newConn(tr, bufio.NewReader(tr), bufio.NewWriter(tr))
+
+	readErr := make(chan error, 1)
+	go func() {
+		_, _, err := c.readMessage()
+		readErr <- err
+	}()
+
+	if err := c.writeFrame(opBinary, make([]byte, 1000)); !errors.Is(err, syscall.EPIPE) {
+		t.Fatalf("writeFrame() error = %v, want EPIPE", err)
+	}
+	select {
+	case err := <-readErr:
+		if err == nil {
+			t.Error("readMessage() error = nil, want an error")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("readMessage() still blocked after the write failed")
+	}
+	select {
+	case <-c.ctx.Done():
+	default:
+		t.Error("connection context not canceled after the write failed")
+	}
+}
+
+// メッセージがmaxMessageSizeを超えた場合は、宣言されたサイズと上限を持つmessageTooBigErrorを返し、1009で切断する
+func TestMessageTooBig(t *testing.T) {
+	c, out := newTestConn(
+		clientFrame(false, opText, []byte("123456")),
+		clientFrame(true, opContinuation, []byte("789012")),
+	)
+	c.maxMessageSize = 10
+
+	err := c.run(func(opcode, []byte) error { return nil })
+	var mt *messageTooBigError
+	if !errors.As(err, &mt) {
+		t.Fatalf("run() error = %v, want a messageTooBigError", err)
+	}
+	if mt.declared != 12 || mt.limit != 10 {
+		t.Errorf("declared, limit = %d, %d; want 12, 10", mt.declared, mt.limit)
+	}
+	frames := parseServerFrames(t, out.Bytes())
+	if len(frames) != 1 || frames[0].opcode != opClose || frames[0].closeCode() != 1009 {
+		t.Errorf("wrote %+v, want a single close 1009", frames)
+	}
+}
+
+// 別のgoroutineがメッセージを送り続けている間に相手のcloseに応答した場合、
+// それ以降の書き込みは通信路に書き込まずにerrConnClosedで失敗し、closeフレームの後にデータフレームは送られない
+func TestWriteAfterPeerClose(t *testing.T) {
+	c, out := newTestConn(clientClose(1000, ""))
+
+	started := make(chan struct{})
+	writeErr := make(chan error, 1)
+	go func() {
+		for i := 0; ; i++ {
+			if i == 1 {
+				close(started)
+			}
+			if err := c.writeFrame(opText, []byte("queued")); err != nil {
+				writeErr <- err
+				return
+			}
+		}
+	}()
+	<-started
+
+	var ce *closeError
+	if _, _, err := c.readMessage(); !errors.As(err, &ce) {
+		t.Fatalf("readMessage() error = %v, want closeError", err)
+	}
+	if err := <-writeErr; !errors.Is(err, errConnClosed) {
+		t.Fatalf("writeFrame() after the close error = %v, want errConnClosed", err)
+	}
+
+	closed := false
+	for _, f := range parseServerFrames(t, out.Bytes()) {
+		switch {
+		case f.opcode == opClose:
+			closed = true
+		case closed:
+			t.Fatalf("data frame %q written after the close frame", f.payload)
+		}
+	}
+	if !closed {
+		t.Error("close reply not written")
+	}
+}
+
+// frameInterceptorでバイナリフレームを拒否する
+// 受信したフレームは1008で接続を終了し、送信するフレームは書き込まずにエラーを返す
+func TestFrameInterceptorRejectsBinary(t *testing.T) {
+	errBinary := errors.New("binary frames not allowed")
+	var mu sync.Mutex
+	var seen []opcode
+	rejectBinary := func(dir frameDirection, h frameHeader, payload []byte) error {
+		// 受信側と送信側から同時に呼ばれることがあるので、記録はロックを取って行う
+		mu.Lock()
+		seen = append(seen, h.opcode)
+		mu.Unlock()
+		if h.opcode == opBinary {
+			return errBinary
+		}
+		return nil
+	}
+
+	t.Run("read", func(t *testing.T) {
+		c, out := newTestConn(
+			clientFrame(true, opText, []byte("ok")),
+			clientFrame(true, opBinary, []byte{1, 2, 3}),
+		)
+		c.frameInterceptor = rejectBinary
+		var got []string
+		err := c.run(func(op opcode, payload []byte) error {
+			got = append(got, string(payload))
+			return nil
+		})
+		if !errors.Is(err, errBinary) {
+			t.Fatalf("run() error = %v, want %v", err, errBinary)
+		}
+		if len(got) != 1 || got[0] != "ok" {
+			t.Errorf("messages = %q, want only \"ok\"", got)
+		}
+		frames := parseServerFrames(t, out.Bytes())
+		if len(frames) != 1 || frames[0].closeCode() != 1008 {
+			t.Errorf("wrote %+v, want a single close 1008", frames)
+		}
+	})
+
+	t.Run("write", func(t *testing.T) {
+		c, peer := newPipeConn(t)
+		c.frameInterceptor = rejectBinary
+		go io.Copy(io.Discard, peer)
+
+		// heartbeatのpingと同時に書き込んでも、インターセプターの呼び出しで競合しない
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 10 {
+				c.writeControl(opPing, nil, time.Now().Add(time.Second))
+			}
+		}()
+		if err := c.writeFrame(opBinary, []byte{1, 2, 3}); !errors.Is(err, errBinary) {
+			t.Errorf("writeFrame(binary) error = %v, want %v", err, errBinary)
+		}
+		if err := c.writeFrame(opText, []byte("ok")); err != nil {
+			t.Errorf("writeFrame(text) error = %v, want nil", err)
+		}
+		wg.Wait()
+		mu.Lock()
+		defer mu.Unlock()
+		if !slices.Contains(seen, opPing) {
+			t.Errorf("interceptor saw %v, want the pings too", seen)
+		}
+	})
+}
+
+// closeフレームの理由はUTF-8でなければならない
+func TestInvalidUTF8CloseReason(t *testing.T) {
+	t.Run("read", func(t *testing.T) {
+		c, out := newTestConn(clientClose(1000, "bad\xff"))
+		_, _, err := c.readMessage()
+		var fe *frameError
+		if !errors.As(err, &fe) || fe.code != 1007 {
+			t.Fatalf("readMessage() error = %v, want frameError 1007", err)
+		}
+		if out.Len() != 0 {
+			t.Errorf("wrote % x before the caller closed", out.Bytes())
+		}
+	})
+
+	t.Run("write", func(t *testing.T) {
+		c, out := newTestConn()
+		if err := c.writeCloseFrame(1000, "bad\xff"); !errors.Is(err, errInvalidCloseReason) {
+			t.Fatalf("writeCloseFrame() error = %v, want errInvalidCloseReason", err)
+		}
+		if out.Len() != 0 {
+			t.Errorf("wrote % x, want nothing", out.Bytes())
+		}
+	})
+}
+
+// ペイロード長0のデータフレームも正しいフレームで、空のメッセージや空のフラグメントになる
+func TestZeroLengthDataFrames(t *testing.T) {
+	tests := []struct {
+		name   string
+		frames [][]byte
+		want   string
+	}{
+		{"empty text", [][]byte{clientFrame(true, opText, nil)}, ""},
+		{
+			"empty middle fragment",
+			[][]byte{
+				clientFrame(false, opText, []byte("ab")),
+				clientFrame(false, opContinuation, nil),
+				clientFrame(true, opContinuation, []byte("cd")),
+			},
+			"abcd",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := newTestConn(tt.frames...)
+			op, payload, err := c.readMessage()
+			if err != nil || op != opText || string(payload) != tt.want {
+				t.Fatalf("readMessage() = %v, %q, %v; want text %q", op, payload, err, tt.want)
+			}
+		})
+	}
+}
+
+// 送受信したバイト数は、ヘッダー(拡張ペイロード長とマスキングキーを含む)とペイロードの合計になる
+func TestByteCounters(t *testing.T) {
+	c, out := newTestConn(
+		clientFrame(true, opText, make([]byte, 5)),       // 2 + 4 + 5
+		clientFrame(true, opBinary, make([]byte, 200)),   // 2 + 2 + 4 + 200
+		clientFrame(true, opPing, []byte("p")),           // 2 + 4 + 1(pongを返す)
+		clientFrame(true, opBinary, make([]byte, 70000)), // 2 + 8 + 4 + 70000
+	)
+	for range 3 {
+		op, payload, err := c.readMessage()
+		if err != nil {
+			t.Fatalf("readMessage() error = %v", err)
+		}
+		if err := c.writeFrame(op, payload); err != nil {
+			t.Fatalf("writeFrame() error = %v", err)
+		}
+	}
+
+	if got, want := c.bytesRead.Load(), int64(11+208+7+70014); got != want {
+		t.Errorf("bytesRead = %d, want %d", got, want)
+	}
+	// 5, 200, 70000バイトのエコーと1バイトのpong
+	if got, want := c.bytesWritten.Load(), int64(7+204+3+70010); got != want {
+		t.Errorf("bytesWritten = %d, want %d", got, want)
+	}
+	if got := c.bytesWritten.Load(); got != int64(out.Len()) {
+		t.Errorf("bytesWritten = %d, but %d bytes reached the transport", got, out.Len())
+	}
+}
+
+// setStateで紐づけた値はstateで取り出せ、nilを設定すると削除される
+func TestConnState(t *testing.T) {
+	type stateKey string
+	c, _ := newTestConn()
+
+	if v := c.state(stateKey("user")); v != nil {
+		t.Fatalf("state() before setState = %v, want nil", v)
+	}
+	c.setState(stateKey("user"), "alice")
+	c.setState(stateKey("room"), 42)
+	if v := c.state(stateKey("user")); v != "alice" {
+		t.Errorf("state(user) = %v, want alice", v)
+	}
+	if v := c.state(stateKey("room")); v != 42 {
+		t.Errorf("state(room) = %v, want 42", v)
+	}
+	// keyの型が異なれば、同じ文字列でも別のkeyになる
+	if v := c.state("user"); v != nil {
+		t.Errorf("state(\"user\") = %v, want nil", v)
+	}
+
+	c.setState(stateKey("user"), nil)
+	if v := c.state(stateKey("user")); v != nil {
+		t.Errorf("state(user) after deleting = %v, want nil", v)
+	}
+	if v := c.state(stateKey("room")); v != 42 {
+		t.Errorf("state(room) after deleting user = %v, want 42", v)
+	}
+}
+
+// 読み込みと書き込みのgoroutineから同時にstateにアクセスしてもよい(-raceで確認する)
+func TestConnStateConcurrent(t *testing.T) {
+	c, _ := newTestConn()
+	var wg sync.WaitGroup
+	for i := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range 1000 {
+				c.setState(i, j)
+				if v, ok := c.state(i).(int); !ok || v != j {
+					t.Errorf("state(%d) = %v, want %d", i, c.state(i), j)
+					return
+				}
+				c.state((i + 1) % 8)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// pongを返している間は接続を保ち、相手が応答しなくなるとtimeout後に読み込みがタイムアウトする
+func TestHeartbeatPeerStopsResponding(t *testing.T) {
+	const interval, timeout = 20 * time.Millisecond, 100 * time.Millisecond
+	c, peer := newPipeConn(t)
+	if err := c.enableHeartbeat(interval, timeout); err != nil {
+		t.Fatalf("enableHeartbeat() error = %v", err)
+	}
+
+	// timeoutより長い間pongを返し続けてから、読み込みは続けたままpongを返さなくなる
+	stopAt := time.Now().Add(3 * timeout)
+	go func() {
+		for {
+			f, err := readServerFrame(peer)
+			if err != nil {
+				return
+			}
+			if f.opcode == opPing && time.Now().Before(stopAt) {
+				if _, err := peer.Write(clientFrame(true, opPong, f.payload)); err != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	_, _, err := c.readMessage()
+	returned := time.Now()
+	var ne net.Error
+	if !errors.As(err, &ne) || !ne.Timeout() {
+		t.Fatalf("readMessage() error = %v, want a timeout net.Error", err)
+	}
+	if returned.Before(stopAt) {
+		t.Errorf("readMessage() timed out %v before the peer stopped responding", stopAt.Sub(returned))
+	}
+	if late := returned.Sub(stopAt); late > timeout+time.Second {
+		t.Errorf("readMessage() timed out %v after the peer stopped responding, want about %v", late, timeout)
+	}
+}
+
+func TestCloseCodeText(t *testing.T) {
+	tests := []struct {
+		code int
+		want string
+	}{
+		{1000, "normal closure"},
+		{1001, "going away"},
+		{1002, "protocol error"},
+		{1007, "invalid frame payload data"},
+		{1009, "message too big"},
+		{1011, "internal error"},
+		{1015, "TLS handshake failure"},
+		{1004, "unknown status code"},
+		{2999, "unknown status code"},
+		{3000, "registered status code (library/framework)"},
+		{3999, "registered status code (library/framework)"},
+		{4000, "private status code (application)"},
+		{4999, "private status code (application)"},
+		{5000, "unknown status code"},
+	}
+	for _, tt := range tests {
+		if got := closeCodeText(tt.code); got != tt.want {
+			t.Errorf("closeCodeText(%d) = %q, want %q", tt.code, got, tt.want)
+		}
+	}
+}
+
+func TestCloseErrorString(t *testing.T) {
+	if got := (&closeError{code: 1001}).Error(); got != "close 1001 (going away)" {
+		t.Errorf("Error() = %q", got)
+	}
+	if got := (&closeError{code: 4000, text: "room closed"}).Error(); got != "close 4000 (private status code (application)): room closed" {
+		t.Errorf("Error() = %q", got)
+	}
+}
+
+// deadlineRecorder は設定された書き込みのデッドラインを記録する通信路
+type deadlineRecorder struct {
+	bytes.Buffer
+	deadlines []time.Time
+}
+
+func (r *deadlineRecorder) SetWriteDeadline(t time.Time) error {
+	r.deadlines = append(r.deadlines, t)
+	return nil
+}
+
+// 制御フレームは渡されたデッドラインで書き込み、書き終えたらデータの書き込み用のデッドラインに戻す
+func TestWriteControlDeadline(t *testing.T) {
+	t.Run("restores the data deadline", func(t *testing.T) {
+		tr := &deadlineRecorder{}
+		c := newConn(tr, bufio.NewReader(tr), bufio.NewWriter(tr))
+		c.writeTimeout = time.Hour
+		if err := c.writeFrame(opText, []byte("data")); err != nil {
+			t.Fatalf("writeFrame() error = %v", err)
+		}
+		dataDeadline := c.writeDeadline
+
+		controlDeadline := time.Now().Add(time.Second)
+		if err := c.writeControl(opPing, nil, controlDeadline); err != nil {
+			t.Fatalf("writeControl() error = %v", err)
+		}
+		want := []time.Time{dataDeadline, controlDeadline, dataDeadline}
+		if !slices.EqualFunc(tr.deadlines, want, time.Time.Equal) {
+			t.Errorf("write deadlines = %v, want %v", tr.deadlines, want)
+		}
+	})
+
+	// データの書き込みに長いデッドラインが設定されていても、相手が読み込まなければ制御フレームのデッドラインで失敗する
+	t.Run("does not inherit the data deadline", func(t *testing.T) {
+		c, peer := newPipeConn(t)
+		c.writeTimeout = time.Hour
+		go readServerFrame(peer)
+		if err := c.writeFrame(opText, []byte("data")); err != nil {
+			t.Fatalf("writeFrame() error = %v", err)
+		}
+
+		start := time.Now()
+		err := c.writeControl(opPing, nil, time.Now().Add(50*time.Millisecond))
+		var ne net.Error
+		if !errors.As(err, &ne) || !ne.Timeout() {
+			t.Fatalf("writeControl() error = %v, want a timeout net.Error", err)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("writeControl() blocked for %v, want about 50ms", elapsed)
+		}
+	})
+}
+
+// 読み込みのタイムアウトは、Timeout()がtrueのnet.Errorとして返す
+func TestReadTimeout(t *testing.T) {
+	for _, perFrame := range []bool{false, true} {
+		c, _ := newPipeConn(t)
+		c.readTimeout = 50 * time.Millisecond
+		c.readDeadlinePerFrame = perFrame
+
+		_, _, err := c.readMessage()
+		var ne net.Error
+		if !errors.As(err, &ne) || !ne.Timeout() {
+			t.Errorf("perFrame=%v: readMessage() error = %v, want a timeout net.Error", perFrame, err)
+		}
+		var fe *frameError
+		if errors.As(err, &fe) {
+			t.Errorf("perFrame=%v: timeout reported as a frameError %d", perFrame, fe.code)
+		}
+	}
+}
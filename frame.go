@@ -0,0 +1,376 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"slices"
+	"unicode/utf8"
+)
+
+// frameError は受信したフレームに問題があり、closeフレームを送って接続を終了すべきことを表すエラー
+type frameError struct {
+	code   int // 送信するcloseフレームのステータスコード
+	reason string
+	// 詳しい原因(なくてもよい)。reasonはcloseフレームで相手に送るので短くし、ログに残したい詳細はこちらに入れる
+	err error
+}
+
+func (e *frameError) Error() string {
+	if e.err != nil {
+		return e.reason + ": " + e.err.Error()
+	}
+	return e.reason
+}
+
+func (e *frameError) Unwrap() error {
+	return e.err
+}
+
+// messageTooBigError はメッセージがmaxMessageSizeを超えたことを表す
+// 上限の調整に使えるよう、相手が送ろうとしたサイズと上限の両方を持つ
+// 1009(message too big)のframeErrorに包んで返すので、closeフレームの送信はframeErrorと同様に呼び出し元で行う
+type messageTooBigError struct {
+	declared int64 // これまでに受信したフラグメントと、ヘッダーで宣言されたこのフレームのペイロード長の合計
+	limit    int64
+}
+
+func (e *messageTooBigError) Error() string {
+	return fmt.Sprintf("declared %d bytes, limit %d bytes", e.declared, e.limit)
+}
+
+// opcode はフレームの種類
+// see https://www.rfc-editor.org/rfc/rfc6455#section-5.2
+type opcode byte
+
+const (
+	opContinuation opcode = 0x0
+	opText         opcode = 0x1
+	opBinary       opcode = 0x2
+	opClose        opcode = 0x8
+	opPing         opcode = 0x9
+	opPong         opcode = 0xA
+)
+
+// isControl は制御フレーム(close, ping, pong)のopcodeかどうかを返す
+// 最上位ビットが立っているもの(0x8~0xF)が制御フレームで、フラグメント化できず、ペイロードは125バイト以下に制限される
+func (op opcode) isControl() bool {
+	return op&0x8 != 0
+}
+
+// isDefined はRFC 6455で定義されているopcodeかどうかを返す(予約されているものはfalse)
+func (op opcode) isDefined() bool {
+	switch op {
+	case opContinuation, opText, opBinary, opClose, opPing, opPong:
+		return true
+	}
+	return false
+}
+
+// String はログに出すためのopcodeの名前を返す
+func (op opcode) String() string {
+	switch op {
+	case opContinuation:
+		return "continuation"
+	case opText:
+		return "text"
+	case opBinary:
+		return "binary"
+	case opClose:
+		return "close"
+	case opPing:
+		return "ping"
+	case opPong:
+		return "pong"
+	}
+	return fmt.Sprintf("reserved(0x%X)", byte(op))
+}
+
+// frameDirection はフレームを受信したのか送信するのかを表す
+type frameDirection int
+
+const (
+	frameRead frameDirection = iota
+	frameWrite
+)
+
+func (d frameDirection) String() string {
+	if d == frameWrite {
+		return "write"
+	}
+	return "read"
+}
+
+// frameHeader はフレームのペイロードより前の部分
+type frameHeader struct {
+	fin        bool
+	opcode     opcode
+	masked     bool
+	maskingKey [4]byte
+	payloadLen int
+	headerLen  int // 拡張ペイロード長とマスキングキーを含むヘッダーのバイト数
+}
+
+// readFrameHeader はフレームのヘッダーを読み込む
+// ペイロードを読む前にサイズを確認できるよう、ペイロードはreadFramePayloadで別に読み込む
+func readFrameHeader(r io.Reader) (h frameHeader, err error) {
+	// 各データフレームは以下の形式で構成されている
+	// see https://www.rfc-editor.org/rfc/rfc6455#section-5.2
+	/*
+			     0                   1                   2                   3
+		         0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1
+		        +-+-+-+-+-------+-+-------------+-------------------------------+
+		        |F|R|R|R| opcode|M| Payload len |    Extended payload length    |
+		        |I|S|S|S|  (4)  |A|     (7)     |             (16/64)           |
+		        |N|V|V|V|       |S|             |   (if payload len==126/127)   |
+		        | |1|2|3|       |K|             |                               |
+		        +-+-+-+-+-------+-+-------------+ - - - - - - - - - - - - - - - +
+		        |     Extended payload length continued, if payload len == 127  |
+		        + - - - - - - - - - - - - - - - +-------------------------------+
+		        |                               |Masking-key, if MASK set to 1  |
+		        +-------------------------------+-------------------------------+
+		        | Masking-key (continued)       |          Payload Data         |
+		        +-------------------------------- - - - - - - - - - - - - - - - +
+		        :                     Payload Data continued ...                :
+		        + - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - +
+		        |                     Payload Data continued ...                |
+		        +---------------------------------------------------------------+
+	*/
+
+	const (
+		finBit    = 1 << 7
+		maskedBit = 1 << 7
+	)
+
+	// 必須の先頭2バイトを読む
+	header := make([]byte, 2)
+	if _, err = io.ReadFull(r, header); err != nil {
+		return
+	}
+
+	h.fin = (header[0] & finBit) != 0
+	rsv := header[0] & 0x70             // 0x70 = 01110000
+	h.opcode = opcode(header[0] & 0x0F) // 0x0F = 00001111
+	h.masked = (header[1] & maskedBit) != 0
+	payloadLen := int(header[1] & 0x7F) // 0x7F = 01111111
+
+	// RSV1~3は拡張機能(permessage-deflateのRSV1など)のためのビットで、
+	// 拡張機能をネゴシエートしていない場合は0でなければならない
+	// このサーバーは拡張機能に対応していないので、どれかが立っていればプロトコル違反
+	if rsv != 0 {
+		err = &frameError{code: 1002, reason: "reserved bits must be 0"}
+		return
+	}
+
+	// クライアントからサーバーへのフレームは必ずマスクしなければならず、サーバーはマスクされていないフレームを受信したら接続を終了しなければならない
+	// see https://www.rfc-editor.org/rfc/rfc6455#section-5.1
+	// このパッケージはサーバーとしてのみフレームを読み込むので、常にマスクを要求する
+	if !h.masked {
+		err = &frameError{code: 1002, reason: "client frame must be masked"}
+		return
+	}
+
+	// opcodeは、0x0がcontinuationフレーム、0x1がテキストフレーム、0x2がバイナリフレーム、
+	// 0x8がcloseフレーム、0x9がpingフレーム、0xAがpongフレーム
+	// 0x3~0x7(データフレーム)と0xB~0xF(制御フレーム)は将来のために予約されていて、受信した場合はプロトコル違反
+	// continuationフレームはフラグメント化されたメッセージの途中でのみ有効で、それはreadMessageで確認する
+	if !h.opcode.isDefined() {
+		err = &frameError{code: 1002, reason: fmt.Sprintf("reserved opcode 0x%X", byte(h.opcode))}
+		return
+	}
+
+	// 制御フレームのペイロードは125バイト以下でなければならない
+	// 126以上の場合は拡張ペイロード長を使うことになるので、先頭2バイトの時点で判定できる
+	if h.opcode.isControl() && payloadLen > maxControlFramePayload {
+		err = &frameError{code: 1002, reason: "control frame payload too large"}
+		return
+	}
+
+	if payloadLen == 126 {
+		ext := make([]byte, 2)
+		if _, err = io.ReadFull(r, ext); err != nil {
+			return
+		}
+		// example:
+		//   ext[0] = 00000001 = 1
+		//   ext[1] = 01111110 = 126
+		//   payloadLen = 1<<8 | 126 = 256 + 126 = 382
+		payloadLen = int(ext[0])<<8 | int(ext[1])
+		// 長さは必要最小限のバイト数で表さなければならず、125以下の長さに2バイトの形式を使うのは不正
+		// see https://www.rfc-editor.org/rfc/rfc6455#section-5.2 ("the minimal number of bytes MUST be used")
+		if payloadLen < 126 {
+			err = &frameError{code: 1002, reason: "non-minimal payload length encoding"}
+			return
+		}
+	} else if payloadLen == 127 {
+		ext := make([]byte, 8)
+		if _, err = io.ReadFull(r, ext); err != nil {
+			return
+		}
+		// 64bitの長さの最上位ビットは0でなければならない
+		// 立っているとintでは負の値になってしまうので、ここで不正なフレームとして扱う
+		n := binary.BigEndian.Uint64(ext)
+		if n>>63 != 0 {
+			err = &frameError{code: 1002, reason: "invalid payload length"}
+			return
+		}
+		// 65535以下の長さは2バイトの形式で表せるので、8バイトの形式を使うのは不正(126の形式と同様)
+		if n <= 0xFFFF {
+			err = &frameError{code: 1002, reason: "non-minimal payload length encoding"}
+			return
+		}
+		// 32bit環境ではintに収まらない長さもあるので、受け付けられないほど大きいメッセージとして扱う
+		if n > math.MaxInt {
+			err = &frameError{code: 1009, reason: "message too big"}
+			return
+		}
+		payloadLen = int(n)
+	}
+
+	h.payloadLen = payloadLen
+
+	if h.masked {
+		if _, err = io.ReadFull(r, h.maskingKey[:]); err != nil {
+			return
+		}
+	}
+
+	h.headerLen = 2
+	switch header[1] & 0x7F {
+	case 126:
+		h.headerLen += 2
+	case 127:
+		h.headerLen += 8
+	}
+	if h.masked {
+		h.headerLen += 4
+	}
+
+	return
+}
+
+// payloadReadChunk はreadFramePayloadが一度に拡張して読み込む最大のバイト数
+const payloadReadChunk = 64 << 10
+
+// readFramePayload はhのペイロードを読み込んでdstの末尾に追加し、追加した部分のマスクを解除して返す
+// フラグメントを組み立てるときは、組み立て中のバッファをdstに渡すとフレームごとにコピーせずに済む
+func readFramePayload(r io.Reader, h frameHeader, dst []byte) ([]byte, error) {
+	// ペイロード長が0のフレームも正しいフレーム(空のメッセージや、フラグメントの途中の空のフレーム)
+	// マスキングキーはヘッダーと一緒に読み込み済みなので、ここでは何も読まなくてよい
+	if h.payloadLen == 0 {
+		return dst, nil
+	}
+
+	// 宣言された長さの分を先にまとめて確保すると、ヘッダーだけ送ってペイロードを送らない相手に
+	// 大きなメモリを確保させられてしまうので、実際に届いた分に合わせてpayloadReadChunkずつ拡張しながら読む
+	// slices.Growはappendと同様に倍々で拡張するので、大きなペイロードでも再確保の回数は少ない
+	n := len(dst)
+	for remaining := h.payloadLen; remaining > 0; {
+		chunk := min(remaining, payloadReadChunk)
+		m := len(dst)
+		dst = slices.Grow(dst, chunk)[:m+chunk]
+		if _, err := io.ReadFull(r, dst[m:]); err != nil {
+			return nil, err
+		}
+		remaining -= chunk
+	}
+	payload := dst[n:]
+
+	if h.masked {
+		for i := range h.payloadLen {
+			payload[i] ^= h.maskingKey[i%4]
+		}
+	}
+
+	return dst, nil
+}
+
+// 制御フレーム(close, ping, pong)のペイロードの最大長
+// see https://www.rfc-editor.org/rfc/rfc6455#section-5.5
+const maxControlFramePayload = 125
+
+var (
+	errControlFrameTooLarge = errors.New("control frame payload too large")
+	errInvalidCloseReason   = errors.New("close reason must be valid UTF-8")
+	errCloseCodeNotAllowed  = errors.New("close code must not be sent")
+)
+
+// formatCloseMessage はcloseフレームのペイロード(ビッグエンディアンで2バイトのステータスコード + 理由)を作る
+// 多くのコネクションに同じ理由で送る場合(サーバーの終了時など)は、一度だけ作ってwriteControlに渡せばよい
+// 送ってはいけないステータスコード(1005など、isValidCloseCodeを参照)や、制御フレームに収まらない理由、UTF-8でない理由はエラーになる
+func formatCloseMessage(code int, reason string) ([]byte, error) {
+	if !isValidCloseCode(code) {
+		return nil, fmt.Errorf("%w: %d", errCloseCodeNotAllowed, code)
+	}
+	// ステータスコードの2バイトと合わせて制御フレームの上限に収まる必要がある
+	if 2+len(reason) > maxControlFramePayload {
+		return nil, errControlFrameTooLarge
+	}
+	if !utf8.ValidString(reason) {
+		return nil, errInvalidCloseReason
+	}
+
+	payload := make([]byte, 2+len(reason))
+	payload[0] = byte(code >> 8)
+	payload[1] = byte(code)
+
+	copy(payload[2:], reason)
+
+	return payload, nil
+}
+
+// frameHeaderLen はwriteFrameがペイロード長payloadLenのフレームに付けるヘッダーのバイト数を返す
+func frameHeaderLen(payloadLen int) int {
+	switch {
+	case payloadLen < 126:
+		return 2
+	case payloadLen <= 0xFFFF:
+		return 2 + 2
+	default:
+		return 2 + 8
+	}
+}
+
+func writeFrame(w io.Writer, op opcode, payload []byte) error {
+	if op.isControl() && len(payload) > maxControlFramePayload {
+		return errControlFrameTooLarge
+	}
+
+	payloadLen := len(payload)
+
+	// 126バイト未満の小さなメッセージ(テキストやJSONなど)が最も多いので、
+	// バッファ付きのWriterであればヘッダーの2バイトを直接書き込み、ヘッダー用のスライスを確保しないようにする
+	// ヘッダーとペイロードはバッファの中でつながるので、フラッシュ時に1回の書き込みで送られる
+	if bw, ok := w.(io.ByteWriter); ok && payloadLen < 126 {
+		if err := bw.WriteByte(0x80 | byte(op)); err != nil {
+			return err
+		}
+		if err := bw.WriteByte(byte(payloadLen)); err != nil {
+			return err
+		}
+		_, err := w.Write(payload)
+		return err
+	}
+
+	// 送信時はマスクしないため、Finとopcodeのみをセット
+	header := []byte{0x80 | byte(op)}
+
+	if payloadLen < 126 {
+		header = append(header, byte(payloadLen))
+	} else if payloadLen <= 0xFFFF {
+		header = append(header, 126, byte(payloadLen>>8), byte(payloadLen))
+	} else {
+		header = append(header, 127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(header[2:], uint64(payloadLen))
+	}
+
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	if _, err := w.Write(payload); err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+// maskedHeader はlenByte(先頭2バイト目のペイロード長)と拡張ペイロード長extを持つ、
+// マスクされたバイナリフレームのヘッダーを作る
+func maskedHeader(lenByte byte, ext ...byte) []byte {
+	b := append([]byte{0x82, 0x80 | lenByte}, ext...)
+	return append(b, testMaskingKey[:]...)
+}
+
+// headerTest はreadFrameHeaderのテストケース
+// wantCodeが0の場合は受け付けてpayloadLenがwantLenになることを、そうでなければそのステータスコードのframeErrorを期待する
+type headerTest struct {
+	name     string
+	input    []byte
+	wantLen  int
+	wantCode int
+}
+
+func runHeaderTests(t *testing.T, tests []headerTest) {
+	t.Helper()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, err := readFrameHeader(bytes.NewReader(tt.input))
+			if tt.wantCode != 0 {
+				var fe *frameError
+				if !errors.As(err, &fe) || fe.code != tt.wantCode {
+					t.Fatalf("readFrameHeader() error = %v, want frameError %d", err, tt.wantCode)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("readFrameHeader() error = %v", err)
+			}
+			if h.payloadLen != tt.wantLen || h.headerLen != len(tt.input) {
+				t.Errorf("payloadLen, headerLen = %d, %d; want %d, %d", h.payloadLen, h.headerLen, tt.wantLen, len(tt.input))
+			}
+		})
+	}
+}
+
+// 長さは必要最小限のバイト数で表さなければならない
+// see https://www.rfc-editor.org/rfc/rfc6455#section-5.2
+func TestReadFrameHeaderMinimalLength16(t *testing.T) {
+	runHeaderTests(t, []headerTest{
+		{"7bit 0", maskedHeader(0), 0, 0},
+		{"7bit 125", maskedHeader(125), 125, 0},
+		{"16bit 0", maskedHeader(126, 0x00, 0x00), 0, 1002},
+		{"16bit 125", maskedHeader(126, 0x00, 0x7D), 0, 1002},
+		{"16bit 126", maskedHeader(126, 0x00, 0x7E), 126, 0},
+		{"16bit 65535", maskedHeader(126, 0xFF, 0xFF), 65535, 0},
+	})
+}
+
+func TestReadFrameHeaderMinimalLength64(t *testing.T) {
+	runHeaderTests(t, []headerTest{
+		{"64bit 100", maskedHeader(127, 0, 0, 0, 0, 0, 0, 0x00, 0x64), 0, 1002},
+		{"64bit 65535", maskedHeader(127, 0, 0, 0, 0, 0, 0, 0xFF, 0xFF), 0, 1002},
+		{"64bit 65536", maskedHeader(127, 0, 0, 0, 0, 0, 0x01, 0x00, 0x00), 65536, 0},
+		{"64bit most significant bit", maskedHeader(127, 0x80, 0, 0, 0, 0, 0x01, 0x00, 0x00), 0, 1002},
+	})
+}
+
+func TestWriteFrameLengthEncoding(t *testing.T) {
+	tests := []struct {
+		n          int
+		wantHeader []byte
+	}{
+		{0, []byte{0x82, 0}},
+		{125, []byte{0x82, 125}},
+		{126, []byte{0x82, 126, 0x00, 0x7E}},
+		{65535, []byte{0x82, 126, 0xFF, 0xFF}},
+		{65536, []byte{0x82, 127, 0, 0, 0, 0, 0, 0x01, 0x00, 0x00}},
+	}
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		if err := writeFrame(&buf, opBinary, make([]byte, tt.n)); err != nil {
+			t.Fatalf("writeFrame(%d bytes) error = %v", tt.n, err)
+		}
+		if got := buf.Bytes()[:len(tt.wantHeader)]; !bytes.Equal(got, tt.wantHeader) {
+			t.Errorf("writeFrame(%d bytes) header = % x, want % x", tt.n, got, tt.wantHeader)
+		}
+		if buf.Len() != len(tt.wantHeader)+tt.n {
+			t.Errorf("writeFrame(%d bytes) wrote %d bytes, want %d", tt.n, buf.Len(), len(tt.wantHeader)+tt.n)
+		}
+	}
+}
+
+// ペイロードが届かないうちは、宣言された長さの分のメモリを確保しない
+func TestReadFramePayloadHugeDeclaredLength(t *testing.T) {
+	// 2^47バイトを宣言して、実際には3バイトしか送らない
+	input := append(maskedHeader(127, 0, 0, 0x80, 0, 0, 0, 0, 0), 1, 2, 3)
+	r := bytes.NewReader(input)
+	h, err := readFrameHeader(r)
+	if err != nil {
+		t.Fatalf("readFrameHeader() error = %v", err)
+	}
+	if _, err := readFramePayload(r, h, nil); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("readFramePayload() error = %v, want io.ErrUnexpectedEOF", err)
+	}
+}
+
+// payloadReadChunkを超えるペイロードも、dstの末尾に続けて読み込んでマスクを解除する
+func TestReadFramePayloadChunked(t *testing.T) {
+	want := make([]byte, 3*payloadReadChunk+5)
+	for i := range want {
+		want[i] = byte(i * 7)
+	}
+	r := bytes.NewReader(clientFrame(true, opBinary, want))
+	h, err := readFrameHeader(r)
+	if err != nil {
+		t.Fatalf("readFrameHeader() error = %v", err)
+	}
+	got, err := readFramePayload(r, h, []byte("head"))
+	if err != nil {
+		t.Fatalf("readFramePayload() error = %v", err)
+	}
+	if !bytes.Equal(got[:4], []byte("head")) || !bytes.Equal(got[4:], want) {
+		t.Errorf("readFramePayload() returned %d bytes that do not match the payload", len(got))
+	}
+}
+
+// cyclicReader はdataを繰り返し読ませるio.Reader
+type cyclicReader struct {
+	data []byte
+	off  int
+}
+
+func (r *cyclicReader) Read(p []byte) (int, error) {
+	n := copy(p, r.data[r.off:])
+	r.off = (r.off + n) % len(r.data)
+	return n, nil
+}
+
+// 4KBずつのフラグメントに分かれた10MBのメッセージを組み立てる
+func BenchmarkReassembleFragmented(b *testing.B) {
+	const msgSize, fragSize = 10 << 20, 4 << 10
+	var data []byte
+	for off := 0; off < msgSize; off += fragSize {
+		op := opContinuation
+		if off == 0 {
+			op = opBinary
+		}
+		data = append(data, clientFrame(off+fragSize >= msgSize, op, make([]byte, fragSize))...)
+	}
+	r := &cyclicReader{data: data}
+	c := newConn(struct {
+		io.Reader
+		io.Writer
+	}{r, io.Discard}, bufio.NewReader(r), bufio.NewWriter(io.Discard))
+
+	b.SetBytes(msgSize)
+	b.ReportAllocs()
+	for b.Loop() {
+		if _, _, err := c.readMessage(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// 64バイトのメッセージの書き込みを、ヘッダーを直接書き込む経路(bufio.Writer)とヘッダーのスライスを作る経路で比べる
+func BenchmarkWriteFrame64(b *testing.B) {
+	payload := make([]byte, 64)
+	b.Run("buffered", func(b *testing.B) {
+		bw := bufio.NewWriter(io.Discard)
+		b.ReportAllocs()
+		for b.Loop() {
+			if err := writeFrame(bw, opText, payload); err != nil {
+				b.Fatal(err)
+			}
+			bw.Flush()
+		}
+	})
+	b.Run("unbuffered", func(b *testing.B) {
+		b.ReportAllocs()
+		for b.Loop() {
+			if err := writeFrame(io.Discard, opText, payload); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("conn", func(b *testing.B) {
+		c := newConn(struct {
+			io.Reader
+			io.Writer
+		}{strings.NewReader(""), io.Discard}, bufio.NewReader(strings.NewReader("")), bufio.NewWriter(io.Discard))
+		b.ReportAllocs()
+		for b.Loop() {
+			if err := c.writeFrame(opText, payload); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// マスクされたペイロード長0のフレームでも、マスキングキーの4バイトを読み込んでから次のフレームに進む
+func TestMaskedZeroLengthFrame(t *testing.T) {
+	r := bytes.NewReader(append(clientFrame(true, opText, nil), clientFrame(true, opText, []byte("next"))...))
+
+	h, err := readFrameHeader(r)
+	if err != nil || h.payloadLen != 0 || h.headerLen != 6 {
+		t.Fatalf("readFrameHeader() = %+v, %v; want an empty frame with a 6-byte header", h, err)
+	}
+	if p, err := readFramePayload(r, h, nil); err != nil || len(p) != 0 {
+		t.Fatalf("readFramePayload() = %q, %v; want empty", p, err)
+	}
+
+	h, err = readFrameHeader(r)
+	if err != nil {
+		t.Fatalf("readFrameHeader() of the next frame error = %v", err)
+	}
+	p, err := readFramePayload(r, h, nil)
+	if err != nil || string(p) != "next" {
+		t.Fatalf("next frame payload = %q, %v; want \"next\"", p, err)
+	}
+	if r.Len() != 0 {
+		t.Errorf("%d bytes left unconsumed", r.Len())
+	}
+}
+
+// 制御フレームのペイロードは125バイトまで
+// see https://www.rfc-editor.org/rfc/rfc6455#section-5.5
+func TestControlFramePayloadLimit(t *testing.T) {
+	t.Run("read", func(t *testing.T) {
+		for _, tt := range []struct {
+			n        int
+			wantCode int
+		}{{125, 0}, {126, 1002}} {
+			_, err := readFrameHeader(bytes.NewReader(clientFrame(true, opPing, make([]byte, tt.n))))
+			var fe *frameError
+			switch {
+			case tt.wantCode == 0 && err != nil:
+				t.Errorf("%d-byte ping: readFrameHeader() error = %v, want nil", tt.n, err)
+			case tt.wantCode != 0 && (!errors.As(err, &fe) || fe.code != tt.wantCode):
+				t.Errorf("%d-byte ping: readFrameHeader() error = %v, want frameError %d", tt.n, err, tt.wantCode)
+			}
+		}
+	})
+
+	t.Run("write", func(t *testing.T) {
+		var buf bytes.Buffer
+		if err := writeFrame(&buf, opPing, make([]byte, 125)); err != nil {
+			t.Errorf("125-byte ping: writeFrame() error = %v, want nil", err)
+		}
+		buf.Reset()
+		if err := writeFrame(&buf, opPing, make([]byte, 126)); !errors.Is(err, errControlFrameTooLarge) {
+			t.Errorf("126-byte ping: writeFrame() error = %v, want errControlFrameTooLarge", err)
+		}
+		if buf.Len() != 0 {
+			t.Errorf("126-byte ping: wrote %d bytes, want nothing", buf.Len())
+		}
+	})
+}
+
+func TestFormatCloseMessage(t *testing.T) {
+	t.Run("layout", func(t *testing.T) {
+		tests := []struct {
+			code   int
+			reason string
+			want   []byte
+		}{
+			// ステータスコードはビッグエンディアンの2バイトで、その後に理由が続く
+			{1000, "", []byte{0x03, 0xE8}},
+			{1001, "bye", []byte{0x03, 0xE9, 'b', 'y', 'e'}},
+			{4999, "é", []byte{0x13, 0x87, 0xC3, 0xA9}},
+		}
+		for _, tt := range tests {
+			got, err := formatCloseMessage(tt.code, tt.reason)
+			if err != nil || !bytes.Equal(got, tt.want) {
+				t.Errorf("formatCloseMessage(%d, %q) = % x, %v; want % x", tt.code, tt.reason, got, err, tt.want)
+			}
+		}
+		// 理由は2バイトのステータスコードと合わせて125バイトまで
+		if got, err := formatCloseMessage(1000, strings.Repeat("a", 123)); err != nil || len(got) != maxControlFramePayload {
+			t.Errorf("123-byte reason: len = %d, err = %v; want %d, nil", len(got), err, maxControlFramePayload)
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		tests := []struct {
+			code    int
+			reason  string
+			wantErr error
+		}{
+			{999, "", errCloseCodeNotAllowed},
+			{1004, "", errCloseCodeNotAllowed},
+			{1005, "", errCloseCodeNotAllowed},
+			{1006, "", errCloseCodeNotAllowed},
+			{1015, "", errCloseCodeNotAllowed},
+			{2999, "", errCloseCodeNotAllowed},
+			{5000, "", errCloseCodeNotAllowed},
+			{1000, strings.Repeat("a", 124), errControlFrameTooLarge},
+			{1000, "bad\xff", errInvalidCloseReason},
+		}
+		for _, tt := range tests {
+			if _, err := formatCloseMessage(tt.code, tt.reason); !errors.Is(err, tt.wantErr) {
+				t.Errorf("formatCloseMessage(%d, %d-byte reason) error = %v, want %v", tt.code, len(tt.reason), err, tt.wantErr)
+			}
+		}
+	})
+}
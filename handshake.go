@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// magicGUID はSec-WebSocket-Acceptの計算に使う、RFC 6455で決められたGUID
+// see https://www.rfc-editor.org/rfc/rfc6455#section-1.3
+const magicGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// computeAcceptKey はSec-WebSocket-Keyに対するSec-WebSocket-Acceptの値を返す
+// Sec-WebSocket-KeyとGUIDを結合したものをSHA1でハッシュ化して、Base64エンコードする
+// see https://www.rfc-editor.org/rfc/rfc6455#section-4.2.2
+//
+// ハンドシェイクのたびに呼ばれるので、結合やエンコードは固定長のバッファで行い、確保するのは返す文字列だけにする
+func computeAcceptKey(key string) string {
+	// Sec-WebSocket-Keyは16バイトをBase64エンコードした24文字なので、通常はscratchに収まる
+	var scratch [64]byte
+	b := append(append(scratch[:0], key...), magicGUID...)
+	sum := sha1.Sum(b)
+
+	var out [28]byte // base64.StdEncoding.EncodedLen(sha1.Size)
+	base64.StdEncoding.Encode(out[:], sum[:])
+	return string(out[:])
+}
+
+// offeredSubprotocols はSec-WebSocket-Protocolヘッダーからクライアントが提示したサブプロトコルを取り出す
+// ヘッダーは複数行に分かれていることがあり、それぞれにカンマ区切りで優先度の高い順に並んでいる
+func offeredSubprotocols(h http.Header) []string {
+	var protocols []string
+	for _, v := range h.Values("Sec-WebSocket-Protocol") {
+		for _, p := range strings.Split(v, ",") {
+			if p = strings.TrimSpace(p); p != "" {
+				protocols = append(protocols, p)
+			}
+		}
+	}
+	return protocols
+}
+
+// headerSize はヘッダーnameの値(複数行ある場合はその合計)のバイト数を返す
+func headerSize(h http.Header, name string) int {
+	n := 0
+	for _, v := range h.Values(name) {
+		n += len(v)
+	}
+	return n
+}
+
+// handshakeError はクライアントにエラーレスポンスを返し、同じ内容のエラーを返す
+func handshakeError(w http.ResponseWriter, status int, msg string) error {
+	http.Error(w, msg, status)
+	return fmt.Errorf("handshake failed: %s", msg)
+}
+
+// writeHandshakeResponse は101 Switching Protocolsのレスポンスを書き込む
+func writeHandshakeResponse(bw *bufio.Writer, header http.Header) error {
+	if _, err := bw.WriteString("HTTP/1.1 101 Switching Protocols\r\n"); err != nil {
+		return err
+	}
+	if err := header.Write(bw); err != nil {
+		return err
+	}
+	if _, err := bw.WriteString("\r\n"); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
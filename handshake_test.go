@@ -0,0 +1,19 @@
+package main
+
+import "testing"
+
+// RFC 6455 1.3節の例
+// see https://www.rfc-editor.org/rfc/rfc6455#section-1.3
+func TestComputeAcceptKey(t *testing.T) {
+	const key, want = "dGhlIHNhbXBsZSBub25jZQ==", "s3pPLMBiTxaQ9kYGzzhZRbK+xOo="
+	if got := computeAcceptKey(key); got != want {
+		t.Errorf("computeAcceptKey(%q) = %q, want %q", key, got, want)
+	}
+}
+
+func BenchmarkComputeAcceptKey(b *testing.B) {
+	b.ReportAllocs()
+	for b.Loop() {
+		computeAcceptKey("dGhlIHNhbXBsZSBub25jZQ==")
+	}
+}
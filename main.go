@@ -2,14 +2,205 @@ package main
 
 import (
 	"bufio"
-	"crypto/sha1"
-	"encoding/base64"
+	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"net/url"
+	"runtime/debug"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
 )
 
-func websocketHandler(w http.ResponseWriter, r *http.Request) {
+const (
+	// hijackしたコネクションを読み書きするバッファサイズのデフォルト値
+	// バッファを大きくするとシステムコールの回数は減るが、1接続あたりのメモリ消費が増える
+	// 小さなメッセージが中心であれば4KiB程度で十分
+	defaultReadBufferSize  = 4096
+	defaultWriteBufferSize = 4096
+
+	defaultCloseGracePeriod = 5 * time.Second
+
+	defaultMaxMessageSize = 16 << 20 // 16MiB
+
+	// メッセージの組み立て用バッファを次のメッセージで再利用する最大サイズ
+	maxRetainedMessageBuffer = 1 << 20 // 1MiB
+
+	defaultMaxConnections = 1000
+
+	// maxPendingPingsによる1011での切断がpongTimeoutより先に行われるよう、
+	// pingInterval*(maxPendingPings+1)がpongTimeoutより短くなるようにしている(15秒*3 = 45秒 < 60秒)
+	defaultPingInterval    = 15 * time.Second
+	defaultPongTimeout     = 60 * time.Second
+	defaultMaxPendingPings = 2
+
+	// ハンドシェイクでupgradeが解析するヘッダー(Sec-WebSocket-Protocolなど)の値の合計の最大長
+	// ヘッダー全体の大きさはnet/httpがhttp.Server.MaxHeaderBytes(デフォルトは1MB)で制限しているが、
+	// それ以下でも正常なクライアントが送るとは考えられない長さのものは、解析する前に400で拒否する
+	maxHandshakeHeaderSize = 4096
+
+	// 制御フレーム(ping, pong, close)を書き込むときのタイムアウト
+	controlWriteTimeout = 10 * time.Second
+)
+
+type server struct {
+	// 読み込み・書き込みに使うバッファのサイズ(0以下の場合はデフォルト値を使う)
+	// 大きなフレームを扱う場合は64KiB程度にするとスループットが上がる
+	readBufferSize  int
+	writeBufferSize int
+
+	// こちらからcloseフレームを送った後、相手のcloseフレームを待つ最大時間
+	// 0以下の場合は待たずにソケットを閉じる
+	closeGracePeriod time.Duration
+
+	// 組み立て後のメッセージサイズの上限(0以下の場合は無制限)
+	// 超えた場合は1009(message too big)で切断する
+	maxMessageSize int64
+
+	// 同時に接続できるWebSocketコネクションの上限(0以下の場合は無制限)
+	maxConnections int
+	// 現在のコネクション数
+	connections atomic.Int64
+
+	// 読み込みのタイムアウト(0以下の場合はタイムアウトしない)
+	// デフォルトではメッセージ単位で、readMessageを呼んでからメッセージ全体を受信し終えるまでの時間に適用する
+	// 次のメッセージが届くまでの待ち時間も含むので、アイドル時間とメッセージの転送時間を合わせた上限になる
+	// (間に挟まるping/pongなどの制御フレームではデッドラインを延長しない)
+	// readDeadlinePerFrameをtrueにするとフレーム単位になり、フレームを読み始めるたびにデッドラインを延長する
+	// 全体の転送時間は長いがフレーム間の間隔は短い、大きなメッセージを少しずつ送ってくる用途ではフレーム単位が向いている
+	// pingIntervalとは併用できない(readMessageがデッドラインを設定し直すので、pongによるデッドラインの延長が効かなくなる)
+	readTimeout          time.Duration
+	readDeadlinePerFrame bool
+
+	// クライアントが提示したサブプロトコル(Sec-WebSocket-Protocol)の中から使用するものを選ぶ
+	// リクエストのパスや認証情報に応じて選べるよう、リクエストも渡す
+	// 空文字を返した場合はサブプロトコルを使わない。nilの場合もサブプロトコルは使わない
+	// 提示されていないものを返した場合、strictModeでは500で接続を拒否し、そうでなければ警告したうえでそのまま返す
+	subprotocol func(r *http.Request, offered []string) string
+	// trueにすると、クライアントがサブプロトコルを提示したのにどれも選ばれなかった場合に403で接続を拒否する
+	// falseの場合は仕様どおり、サブプロトコルなしでハンドシェイクを完了する
+	requireSubprotocolMatch bool
+
+	// 0より大きい場合は、pingIntervalごとにpingを送り、pongTimeoutの間pongが届かなければ切断する
+	// 詳しくはconn.enableHeartbeatを参照
+	// 読み込みのデッドラインを使うので、readTimeoutは0のままにする
+	pingInterval time.Duration
+	pongTimeout  time.Duration
+	// 応答のないpingがこの数に達した状態で次のpingを送る時刻になった場合は、相手が応答していないとみなし1011で切断する(0以下の場合は無制限)
+	// pongTimeoutによる読み込みのタイムアウトはcloseフレームを送らずに切断するが、こちらは相手に理由を伝えてから切断する
+	// 最後のpongからこの判定までにはpingInterval*(maxPendingPings+1)かかるので、それがpongTimeoutより短くなるように設定する
+	// そうでなければ先に読み込みがタイムアウトし、closeフレームを送らないまま切断される
+	maxPendingPings int
+
+	// 0より大きい場合は、Hijackしたコネクションが対応していればTCPのkeepaliveをこの間隔で有効にする
+	// pingはアプリケーションのレベルで相手の応答を確認するが、keepaliveはOSが行うので、ハンドラーが止まっていても途切れない
+	// 0以下の場合はnet/httpのリスナーの設定のままにする
+	tcpKeepAlivePeriod time.Duration
+
+	// データフレームの書き込みのタイムアウト(0以下の場合はタイムアウトしない)
+	// 制御フレームはこれとは別にcontrolWriteTimeoutで書き込む
+	writeTimeout time.Duration
+
+	// 1つのコネクションから受信できるメッセージ数の上限(1秒あたり、0以下の場合は無制限)
+	// 1秒分までは続けて届いても許可する。超えた場合は、rateLimitBlockがfalseなら1008(policy violation)で切断し、
+	// trueならトークンが補充されるまで次のメッセージを返さずに待つ(その間は読み込みが止まるので、TCPのフロー制御で相手の送信も止まる)
+	maxMessagesPerSecond float64
+	rateLimitBlock       bool
+
+	// 接続を終了するほどではない異常を通知する(詳しくはconn.errorHandlerを参照)
+	errorHandler func(err error)
+
+	// 送受信するすべてのフレーム(制御フレームを含む)について呼ばれる(nilの場合は何もしない)
+	// 詳しくはconn.frameInterceptorを参照
+	frameInterceptor func(dir frameDirection, h frameHeader, payload []byte) error
+
+	// trueにすると、RFC 6455が送信側に禁止しているものの、受信側に接続の終了までは求めていない以下の逸脱を、
+	// 警告(errorHandler)にとどめずにエラーにする
+	//   - 送信してはいけないステータスコード(1005, 1006, 1015, 未定義の範囲など)のcloseフレームを受信した(1002で終了する)
+	//     see https://www.rfc-editor.org/rfc/rfc6455#section-7.4
+	//   - subprotocolがクライアントの提示していないサブプロトコルを選んだ(ハンドシェイクを500で拒否する)
+	//     see https://www.rfc-editor.org/rfc/rfc6455#section-4.2.2
+	// RFCが受信側に接続の終了を求めている違反(マスクされていないフレーム、RSVビット、予約されたopcode、
+	// フラグメントの順序、テキストメッセージの不正なUTF-8など)は、このフラグに関係なく常にエラーになる
+	// 一方的なpongは仕様で認められているので(see https://www.rfc-editor.org/rfc/rfc6455#section-5.5.3)、このフラグを立てても警告だけにとどめる
+	// Autobahn Testsuiteでの検証や、仕様に従わない相手を見つけるのに使う
+	strictMode bool
+
+	// Originヘッダーを検証し、falseを返した場合は403で接続を拒否する
+	// nilの場合はcheckSameOriginで同一オリジンからの接続だけを許可する
+	checkOrigin func(r *http.Request) bool
+	// TLSを終端するリバースプロキシの後ろで動かす場合にtrueにすると、
+	// デフォルトのOriginの検証でForwarded/X-Forwarded-Protoからクライアントのスキームを判定する
+	trustProxyHeaders bool
+
+	// ハンドシェイクのリクエストを認証する(nilの場合は認証しない)
+	// エラーを返した場合はauthenticateFailureStatus(0の場合は401)で接続を拒否する
+	// Hijackする前に呼ぶので、クエリのトークンやAuthorizationヘッダー、Cookieなどを使ってHTTPのレスポンスで拒否できる
+	// エラーの内容はログにだけ出し、クライアントにはステータスコードの説明だけを返す
+	authenticate              func(r *http.Request) error
+	authenticateFailureStatus int
+}
+
+// handler はWebSocketへのアップグレードを行い、準備のできたconnでfnを呼び出すhttp.Handler
+// http.ServeMuxなどのルーターにそのまま登録できる
+type handler struct {
+	s  *server
+	fn func(c *conn)
+}
+
+// newHandler はアップグレード後のconnでfnを呼び出すhttp.Handlerを返す
+// fnはリクエストのgoroutine上で呼ばれ、fnから戻るとコネクションは閉じられる
+func newHandler(s *server, fn func(c *conn)) http.Handler {
+	return &handler{s: s, fn: fn}
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s := h.s
+
+	// 同時接続数が上限に達している場合は、Hijackする前に503を返して接続を拒否する
+	if n := s.connections.Add(1); s.maxConnections > 0 && n > int64(s.maxConnections) {
+		s.connections.Add(-1)
+		http.Error(w, "Too many connections", http.StatusServiceUnavailable)
+		return
+	}
+	defer s.connections.Add(-1)
+
+	c, err := s.upgrade(w, r)
+	if err != nil {
+		fmt.Println("upgrade error:", err)
+		return
+	}
+	defer c.closeTransport()
+	defer func() {
+		st := c.stats()
+		fmt.Printf("Connection stats: bytes read=%d, bytes written=%d, fragmented messages=%d, max fragments=%d, max message size=%d\n",
+			st.bytesRead, st.bytesWritten, st.fragmentedMessages, st.maxFragments, st.maxReassembledSize)
+	}()
+
+	// fnがpanicした場合は、1011(internal error)のcloseフレームを送ってからコネクションを閉じる
+	// recoverしないとcloseフレームを送らないままgoroutineが終了し、相手には突然切断されたように見える
+	defer func() {
+		if v := recover(); v != nil {
+			fmt.Printf("handler panic: %v\n%s", v, debug.Stack())
+			if err := c.close(1011, "internal error"); err != nil {
+				fmt.Println("close error:", err)
+			}
+		}
+	}()
+
+	h.fn(c)
+}
+
+// upgrade はハンドシェイクを行い、HTTPのコネクションをWebSocketのコネクションに切り替える
+// ハンドシェイクに失敗した場合は、クライアントにエラーレスポンスを返したうえでエラーを返す
+func (s *server) upgrade(w http.ResponseWriter, r *http.Request) (*conn, error) {
 	// 以下の形式でclientからハンドシェイクのリクエストが来る
 	// see https://www.rfc-editor.org/rfc/rfc6455#section-1.3
 	/*
@@ -24,189 +215,1109 @@ func websocketHandler(w http.ResponseWriter, r *http.Request) {
 	*/
 
 	if r.Header.Get("Connection") != "Upgrade" || r.Header.Get("Upgrade") != "websocket" {
-		http.Error(w, "Not a websocket upgrade request", http.StatusBadRequest)
-		return
+		return nil, handshakeError(w, http.StatusBadRequest, "Not a websocket upgrade request")
+	}
+
+	for _, name := range []string{"Sec-WebSocket-Key", "Sec-WebSocket-Protocol"} {
+		if headerSize(r.Header, name) > maxHandshakeHeaderSize {
+			return nil, handshakeError(w, http.StatusBadRequest, name+" header too large")
+		}
 	}
 
 	secWebSocketKey := r.Header.Get("Sec-WebSocket-Key")
 	if secWebSocketKey == "" {
-		http.Error(w, "Bad WebSocket handshake", http.StatusBadRequest)
-		return
+		return nil, handshakeError(w, http.StatusBadRequest, "Bad WebSocket handshake")
+	}
+
+	checkOrigin := s.checkOrigin
+	if checkOrigin == nil {
+		checkOrigin = func(r *http.Request) bool {
+			return checkSameOrigin(r, s.trustProxyHeaders)
+		}
+	}
+	if !checkOrigin(r) {
+		return nil, handshakeError(w, http.StatusForbidden, "Origin not allowed")
+	}
+
+	if s.authenticate != nil {
+		if err := s.authenticate(r); err != nil {
+			status := s.authenticateFailureStatus
+			if status == 0 {
+				status = http.StatusUnauthorized
+			}
+			handshakeError(w, status, http.StatusText(status))
+			return nil, fmt.Errorf("handshake failed: authentication: %w", err)
+		}
 	}
 
-	// acceptKeyの作成
-	// Sec-WebSocket-KeyとGUIDを結合したものをSHA1でハッシュ化して、Base64エンコードする
-	const magicGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
-	h := sha1.New()
-	h.Write([]byte(secWebSocketKey + magicGUID))
-	acceptKey := base64.StdEncoding.EncodeToString(h.Sum(nil))
+	acceptKey := computeAcceptKey(secWebSocketKey)
 
-	w.Header().Set("Upgrade", "websocket")
-	w.Header().Set("Connection", "Upgrade")
-	w.Header().Set("Sec-WebSocket-Accept", acceptKey)
-	w.WriteHeader(http.StatusSwitchingProtocols)
+	// サブプロトコルの選択
+	// サーバーは提示されたものの中から1つだけ選べる
+	var subprotocol string
+	offered := offeredSubprotocols(r.Header)
+	if s.subprotocol != nil {
+		subprotocol = s.subprotocol(r, offered)
+		// 提示されていないサブプロトコルを返すと、仕様どおりのクライアントは接続を失敗させる
+		// それでも決め打ちのサブプロトコルを返したい(相手がそれを前提にしている)場合のために、strictModeでなければ警告にとどめてそのまま返す
+		if subprotocol != "" && !slices.Contains(offered, subprotocol) {
+			if s.strictMode {
+				return nil, handshakeError(w, http.StatusInternalServerError, "Selected subprotocol was not offered: "+subprotocol)
+			}
+			if s.errorHandler != nil {
+				s.errorHandler(fmt.Errorf("%w: %s", errSubprotocolNotOffered, subprotocol))
+			}
+		}
+	}
+	// 仕様上は、対応するサブプロトコルがなくてもSec-WebSocket-Protocolを付けずにハンドシェイクを完了してよい
+	// (それでよいかはクライアントが判断する)が、requireSubprotocolMatchの場合はここで拒否する
+	if s.requireSubprotocolMatch && len(offered) > 0 && subprotocol == "" {
+		return nil, handshakeError(w, http.StatusForbidden, "No supported subprotocol")
+	}
 
-	conn, rw, err := http.NewResponseController(w).Hijack()
+	// HTTP/2やミドルウェアでラップされたResponseWriterはHijackに対応していないことがある
+	// 101レスポンスを書き込んだ後にHijackが失敗すると、クライアントにはハンドシェイクが中途半端に見えてしまうため、
+	// 先にHijackしておき、失敗した場合はまだ何も書き込んでいない状態でエラーを返す
+	netConn, rw, err := http.NewResponseController(w).Hijack()
 	if err != nil {
-		http.Error(w, "Hijack failed: "+err.Error(), http.StatusInternalServerError)
-		return
+		return nil, handshakeError(w, http.StatusInternalServerError, "Hijack failed: "+err.Error())
+	}
+
+	if s.tcpKeepAlivePeriod > 0 {
+		if err := setTCPKeepAlive(netConn, s.tcpKeepAlivePeriod); err != nil {
+			netConn.Close()
+			return nil, err
+		}
+	}
+
+	readBufferSize := s.readBufferSize
+	if readBufferSize <= 0 {
+		readBufferSize = defaultReadBufferSize
+	}
+	writeBufferSize := s.writeBufferSize
+	if writeBufferSize <= 0 {
+		writeBufferSize = defaultWriteBufferSize
+	}
+
+	// クライアントがハンドシェイクのリクエストと最初のフレームを続けて送ってきた場合、
+	// フレームの先頭はnet/httpがリクエストを読んだときにhijack時のbufio.Readerへ読み込まれている
+	// その場合はそのbufio.Readerを包んで、読み込み済みのデータから順にフレームを読む
+	// 読み込み済みのデータがなければ、二重にバッファリングしないようコネクションを直接包む
+	var br *bufio.Reader
+	if rw.Reader.Buffered() > 0 {
+		br = bufio.NewReaderSize(rw.Reader, readBufferSize)
+	} else {
+		br = bufio.NewReaderSize(netConn, readBufferSize)
+	}
+	// 書き込みは101レスポンスも含めてすべてこのbufio.Writerから行い、rw.Writerは使わない
+	bw := bufio.NewWriterSize(netConn, writeBufferSize)
+
+	c := newConn(netConn, br, bw)
+	c.closeGracePeriod = s.closeGracePeriod
+	c.maxMessageSize = s.maxMessageSize
+	c.readTimeout = s.readTimeout
+	c.readDeadlinePerFrame = s.readDeadlinePerFrame
+	c.writeTimeout = s.writeTimeout
+	c.errorHandler = s.errorHandler
+	c.frameInterceptor = s.frameInterceptor
+	c.strictMode = s.strictMode
+	c.subprotocol = subprotocol
+	c.maxPendingPings = s.maxPendingPings
+	c.request = newRequestInfo(r)
+	if s.maxMessagesPerSecond > 0 {
+		c.rateLimiter = newRateLimiter(s.maxMessagesPerSecond)
+		c.rateLimitBlock = s.rateLimitBlock
+	}
+
+	// Hijack後はResponseWriterが使えないので、101レスポンスは自分で書き込む
+	header := http.Header{}
+	header.Set("Upgrade", "websocket")
+	header.Set("Connection", "Upgrade")
+	header.Set("Sec-WebSocket-Accept", acceptKey)
+	if subprotocol != "" {
+		header.Set("Sec-WebSocket-Protocol", subprotocol)
+	}
+	if err := writeHandshakeResponse(c.bw, header); err != nil {
+		c.closeTransport()
+		return nil, err
+	}
+
+	if s.pingInterval > 0 {
+		if err := c.enableHeartbeat(s.pingInterval, s.pongTimeout); err != nil {
+			c.closeTransport()
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+// setTCPKeepAlive はncがTCPのコネクションであれば、keepaliveをperiodの間隔で有効にする
+// TLSのコネクションの場合は、その下のTCPのコネクションに設定する
+// TCP以外(Unixドメインソケットなど)の場合は何もしない
+func setTCPKeepAlive(nc net.Conn, period time.Duration) error {
+	if tc, ok := nc.(interface{ NetConn() net.Conn }); ok {
+		nc = tc.NetConn()
+	}
+	tcpConn, ok := nc.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+	if err := tcpConn.SetKeepAlive(true); err != nil {
+		return err
+	}
+	return tcpConn.SetKeepAlivePeriod(period)
+}
+
+// requestInfo はハンドシェイクのリクエストのうち、アップグレード後も参照したい情報
+type requestInfo struct {
+	url        *url.URL
+	header     http.Header
+	remoteAddr string
+}
+
+// newRequestInfo はrから必要な情報だけをコピーする
+// *http.Requestをそのまま保持すると、Bodyやコンテキストなどもコネクションが閉じるまで残ってしまうため、
+// URLとヘッダーは複製して、元のリクエストを参照しないようにする
+func newRequestInfo(r *http.Request) requestInfo {
+	u := *r.URL
+	return requestInfo{
+		url:        &u,
+		header:     r.Header.Clone(),
+		remoteAddr: r.RemoteAddr,
+	}
+}
+
+// echo は受信したメッセージをそのまま送り返す
+func echo(c *conn) {
+	fmt.Printf("Connected: remote=%s path=%s\n", c.request.remoteAddr, c.request.url.Path)
+
+	err := c.run(func(op opcode, payload []byte) error {
+		fmt.Printf("Received message: opcode=%s, payload=%s\n", op, string(payload))
+		if err := c.writeFrame(op, payload); err != nil {
+			return fmt.Errorf("writeFrame: %w", err)
+		}
+		return nil
+	})
+
+	// 相手からcloseフレームを受信した場合は、readMessageの中でcloseフレームを返しているので終了するだけ
+	var ce *closeError
+	var ne net.Error
+	switch {
+	case errors.As(err, &ce):
+		fmt.Println("Received close frame, closing connection:", err)
+	case errors.As(err, &ne) && ne.Timeout():
+		fmt.Println("timeout:", err)
+	default:
+		fmt.Println("connection error:", err)
+	}
+}
+
+// conn はハンドシェイク後のWebSocketコネクション
+type conn struct {
+	// 下位の通信路。net.Connに限らず、プロセス内のパイプや独自のトンネルなど任意のio.ReadWriterを使える
+	// デッドラインの設定やCloseは、通信路が対応している場合のみ行う
+	transport io.ReadWriter
+	br        *bufio.Reader
+	bw        *bufio.Writer
+
+	// ハンドシェイクで選択したサブプロトコル(使わない場合は空文字)
+	subprotocol string
+	// ハンドシェイクのリクエストの情報(ルーティングや認証の判断に使う)
+	request requestInfo
+
+	// アプリケーションがコネクションに紐づけるデータ(ユーザー名やチャットのルームなど)
+	// 読み込みと書き込みのgoroutineのどちらからも触れるので、stateMuで保護する
+	stateMu sync.Mutex
+	states  map[any]any
+
+	// 書き込みは読み込みのgoroutine(pongの返信)やheartbeatのgoroutineからも行われるため、ロックで直列化する
+	writeMu sync.Mutex
+	// データフレームの書き込みのタイムアウトと、現在設定しているデッドライン
+	// 制御フレームを書き込んだ後は、writeDeadlineに戻す
+	writeTimeout  time.Duration
+	writeDeadline time.Time
+	// closeフレームを送信した後はtrueになり、それ以降の書き込みはerrConnClosedで失敗する(writeMuで保護する)
+	closeSent bool
+
+	// pongを受信したときに呼ばれる(読み込みのgoroutineから呼ばれる)
+	pongHandler func(payload []byte)
+	// 送信したpingのうち、まだpongが返ってきていない数
+	pendingPings atomic.Int64
+	// heartbeatで許容するpendingPingsの上限(0以下の場合は無制限)
+	maxPendingPings int
+
+	// 接続を終了するほどではない異常を検出したときに呼ばれる(nilの場合は何もしない)
+	// 接続を終了すべきエラーはreadMessageが返すので、ここには渡さない
+	// 現在は以下の場合に呼ばれる
+	//   - 送信したpingがないのにpongを受信した(errUnsolicitedPong)
+	//   - こちらから送ったcloseフレームに、closeGracePeriodの間に応答がなかった(errCloseTimeout)
+	//   - 送信してはいけないステータスコードのcloseフレームを受信した(errInvalidCloseCode)
+	// strictModeの場合、errInvalidCloseCodeは1002で接続を終了する
+	errorHandler func(err error)
+	strictMode   bool
+
+	// フレームのログやメトリクスの収集、フレーム単位のポリシーの適用に使う
+	// 受信したフレームはペイロードを読み込み、マスクを解除した後に呼ばれる。エラーを返すと1008(policy violation)で接続を終了する
+	// 送信するフレームは書き込む前に呼ばれる。エラーを返すとそのフレームは書き込まず、書き込みがそのエラーで失敗する
+	// payloadは呼び出しの間だけ有効で、変更してはいけない
+	// 受信側は読み込みのgoroutineから、送信側は書き込むgoroutine(heartbeatのpingやハンドラーなど)から呼ばれ、
+	// 両者は同時に呼ばれることがあるので、共有する状態を持つ場合はgoroutine-safeにしなければならない
+	// 送信側どうしはwriteMuで直列化されるので、同時には呼ばれない
+	frameInterceptor func(dir frameDirection, h frameHeader, payload []byte) error
+
+	// コネクションが終了するとキャンセルされるコンテキスト
+	// コネクションに紐づくgoroutineの終了や、ハンドラーから呼び出す処理(DBへの問い合わせなど)の打ち切りに使う
+	// 以下のいずれかでキャンセルされる
+	//   - 相手が切断した(readMessageがio.EOFを返した)
+	//   - 相手からcloseフレームを受信した
+	//   - closeTransportでソケットを閉じた(close、heartbeatによる切断、ハンドラーの終了時など)
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	closeGracePeriod     time.Duration
+	maxMessageSize       int64
+	readTimeout          time.Duration
+	readDeadlinePerFrame bool
+
+	// 受信メッセージ数の制限(nilの場合は制限しない)
+	rateLimiter    *rateLimiter
+	rateLimitBlock bool
+
+	// フラグメント化されたメッセージの組み立て状態
+	fragmenting   bool   // 最初のフレーム(FIN=0)を受信し、continuationフレームを待っている
+	messageOpcode opcode // 組み立て中のメッセージのopcode(最初のフレームのopcode)
+	message       []byte // これまでに受信したフラグメントのペイロード(メッセージをまたいで再利用する)
+	fragments     int    // これまでに受信したフラグメントの数
+
+	// ハンドシェイク後に送受信したバイト数(フレームのヘッダーやマスキングキーを含む)
+	// 通信量の計測に使うため、メッセージのペイロードだけでなく通信路上のバイト数を数える
+	bytesRead    atomic.Int64
+	bytesWritten atomic.Int64
+
+	// 受信したメッセージの統計
+	fragmentedMessages atomic.Int64
+	maxFragments       atomic.Int64
+	maxReassembledSize atomic.Int64
+}
+
+// newConn はtransportの上でWebSocketのフレームを読み書きするconnを作る
+// brとbwはtransportを読み書きするバッファで、brにはtransportから読み込み済みのデータが残っていてもよい
+func newConn(transport io.ReadWriter, br *bufio.Reader, bw *bufio.Writer) *conn {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &conn{
+		transport: transport,
+		br:        br,
+		bw:        bw,
+		ctx:       ctx,
+		cancel:    cancel,
+	}
+}
+
+// setReadDeadline は通信路が対応している場合のみ読み込みのデッドラインを設定する
+// 対応していない通信路では何もしない(タイムアウトしない)
+func (c *conn) setReadDeadline(t time.Time) error {
+	if d, ok := c.transport.(interface{ SetReadDeadline(time.Time) error }); ok {
+		return d.SetReadDeadline(t)
+	}
+	return nil
+}
+
+// setWriteDeadline は通信路が対応している場合のみ書き込みのデッドラインを設定する
+func (c *conn) setWriteDeadline(t time.Time) error {
+	if d, ok := c.transport.(interface{ SetWriteDeadline(time.Time) error }); ok {
+		return d.SetWriteDeadline(t)
+	}
+	return nil
+}
+
+// closeTransport は通信路がio.Closerを実装している場合のみ閉じる
+func (c *conn) closeTransport() error {
+	c.cancel()
+	if cl, ok := c.transport.(io.Closer); ok {
+		return cl.Close()
+	}
+	return nil
+}
+
+// enableHeartbeat はinterval毎にpingを送り、pongを受信するたびに読み込みのデッドラインをtimeout後まで延長する
+// 相手が応答しなくなった(ネットワークが切れたまま気づけない)コネクションは、timeout後に読み込みがタイムアウトする
+// timeoutはintervalより長くする必要がある
+//
+// pingの送信はcontrolWriteTimeoutまでに書き込めなければ失敗する
+// 経路が切れていても、送信バッファに空きがある間は書き込みが成功してしまうので、すぐには検出できないが、
+// 相手が受信しないままデータを送り続けた(送信バッファが埋まった)場合は、pongTimeoutを待たずにソケットを閉じる
+// データフレームの書き込みがブロックしている間はpingもロックを待つので、その場合に備えてwriteTimeoutも設定しておく
+//
+// 読み込みのデッドラインを使うのでreadTimeoutとは併用しない
+// pongHandlerを上書きするため、読み込みを始める前に呼び出す
+func (c *conn) enableHeartbeat(interval, timeout time.Duration) error {
+	if err := c.setReadDeadline(time.Now().Add(timeout)); err != nil {
+		return err
+	}
+	c.pongHandler = func([]byte) {
+		c.setReadDeadline(time.Now().Add(timeout))
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				// 読み込みのgoroutineはフレームを待ってブロックしているので、closeの応答は待たずにソケットを閉じる
+				if c.maxPendingPings > 0 && c.pendingPings.Load() >= int64(c.maxPendingPings) {
+					c.writeCloseFrame(1011, "ping timeout")
+					c.closeTransport()
+					return
+				}
+				// pongはフラッシュした直後に届くこともあり、書き込んでから数えると読み込みのgoroutineが先にpongを処理して
+				// 一方的なpongと誤認してしまうので、書き込む前に数えておき、書き込めなかった場合は取り消す
+				// 書き込みに失敗した場合は、writeControlがソケットを閉じて読み込みのgoroutineも終了させる
+				c.pendingPings.Add(1)
+				if err := c.writeControl(opPing, nil, time.Now().Add(controlWriteTimeout)); err != nil {
+					c.pendingPings.Add(-1)
+					return
+				}
+			case <-c.ctx.Done():
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// readMessage はフレームを読み込み、フラグメント化されたメッセージを組み立てて返す
+// see https://www.rfc-editor.org/rfc/rfc6455#section-5.4
+//
+// 返すpayloadは組み立て用のバッファを再利用しているため、次にreadMessageを呼ぶまでの間だけ有効
+//
+// 制御フレームはフラグメントの間に挟まることがあるため、受信した時点でここで処理する
+// pingにはpongを返し、pongはpongHandlerに渡す(呼び出し元には返さない)
+//
+// closeフレームを受信した場合は、closeフレームを返信したうえで*closeErrorを返す
+// メッセージの組み立て中であっても、そのメッセージは破棄する
+//
+// readTimeoutやheartbeatのデッドラインを過ぎた場合は、通信路が返したエラーをそのまま返す
+// net.Connの場合はTimeout()がtrueのnet.Errorになるので、errors.Asで取り出せばプロトコル違反(*frameError)や切断と区別できる
+func (c *conn) readMessage() (op opcode, payload []byte, err error) {
+	// 相手が切断したかcloseフレームを送ってきた場合は、この後にメッセージが届くことはないので、
+	// ハンドラーがソケットを閉じるのを待たずにコンテキストをキャンセルする
+	defer func() {
+		var ce *closeError
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.As(err, &ce) {
+			c.cancel()
+		}
+	}()
+
+	// メッセージ単位の場合は、呼ばれた時点で一度だけデッドラインを設定する
+	// 最初のヘッダーを待つ時間も含むので、メッセージが届くまでのアイドル時間もこのデッドラインに数える
+	if c.readTimeout > 0 && !c.readDeadlinePerFrame {
+		if err := c.setReadDeadline(time.Now().Add(c.readTimeout)); err != nil {
+			return 0, nil, err
+		}
 	}
-	defer conn.Close()
 
 	for {
-		op, payload, err := readFrame(rw)
+		if c.readTimeout > 0 && c.readDeadlinePerFrame {
+			if err := c.setReadDeadline(time.Now().Add(c.readTimeout)); err != nil {
+				return 0, nil, err
+			}
+		}
+
+		h, err := c.readFrameHeader()
 		if err != nil {
-			fmt.Println("readFrame error:", err)
-			return
+			return 0, nil, err
 		}
+		fin := h.fin
 
-		fmt.Printf("Received frame: opcode=%d, payload=%s\n", op, string(payload))
+		if h.opcode.isControl() {
+			// 制御フレームはフラグメント化できない
+			if !fin {
+				return 0, nil, &frameError{code: 1002, reason: "fragmented control frame"}
+			}
+			data, err := c.readFramePayload(h, nil)
+			if err != nil {
+				return 0, nil, err
+			}
+			switch h.opcode {
+			case opClose:
+				c.fragmenting = false
+				c.message = c.message[:0]
+				c.fragments = 0
+				return 0, nil, c.handleClose(data)
+			case opPing:
+				// pingには同じペイロードのpongを返す
+				if err := c.writeControl(opPong, data, time.Now().Add(controlWriteTimeout)); err != nil {
+					return 0, nil, err
+				}
+			case opPong:
+				// pongは直近のpingに対する応答なので、それまでに送ったpingはすべて応答されたとみなす
+				// pingを送っていないのに届いたpongは、相手が一方的に送るハートビートとして仕様上認められているので、
+				// strictModeであっても警告するだけで受け付ける
+				if c.pendingPings.Swap(0) == 0 {
+					c.warn(errUnsolicitedPong)
+				}
+				if c.pongHandler != nil {
+					c.pongHandler(data)
+				}
+			}
+			continue
+		}
 
-		// closeフレームを受信した場合は、closeフレームを返して終了
-		if op == 0x8 {
-			fmt.Println("Received close frame, closing connection")
-			if err := writeCloseFrame(conn, 0x8, "bye"); err != nil {
-				fmt.Println("writeFrame error:", err)
-				return
+		if c.fragmenting {
+			// メッセージの途中に来てよいデータフレームはcontinuationフレーム(0x0)のみ
+			// ここでtext(0x1)やbinary(0x2)が来た場合は、前のメッセージが終わっていないのでプロトコル違反
+			if h.opcode != opContinuation {
+				return 0, nil, &frameError{code: 1002, reason: "expected continuation frame"}
 			}
-			return
+		} else {
+			// 組み立て中のメッセージがないのにcontinuationフレームが来た場合も、続けるメッセージがないのでプロトコル違反
+			if h.opcode == opContinuation {
+				return 0, nil, &frameError{code: 1002, reason: "unexpected continuation frame"}
+			}
+			c.messageOpcode = h.opcode
 		}
 
-		if err := writeFrame(conn, op, payload); err != nil {
-			fmt.Println("writeFrame error:", err)
-			return
+		// ペイロードを読み込む(バッファを確保する)前に、組み立て後のサイズが上限を超えないか確認する
+		if declared := int64(len(c.message)) + int64(h.payloadLen); c.maxMessageSize > 0 && declared > c.maxMessageSize {
+			return 0, nil, &frameError{
+				code:   1009,
+				reason: "message too big",
+				err:    &messageTooBigError{declared: declared, limit: c.maxMessageSize},
+			}
+		}
+		// 組み立て中のバッファに直接読み込む
+		// バッファが足りない場合はappendと同様に倍々で拡張されるので、大きなメッセージでも再確保の回数は少ない
+		c.message, err = c.readFramePayload(h, c.message)
+		if err != nil {
+			return 0, nil, err
+		}
+		c.fragments++
+
+		if !fin {
+			c.fragmenting = true
+			continue
+		}
+
+		// テキストメッセージはUTF-8でなければならず、そうでなければ1007(invalid frame payload data)で接続を終了する
+		// UTF-8の文字はフラグメントの境界で分かれていることがあるので、組み立てたメッセージ全体で確認する
+		// see https://www.rfc-editor.org/rfc/rfc6455#section-8.1
+		if c.messageOpcode == opText && !utf8.Valid(c.message) {
+			return 0, nil, &frameError{code: 1007, reason: "invalid UTF-8 in text message"}
 		}
+
+		c.recordMessage(c.fragments, len(c.message))
+
+		if err := c.limitRate(); err != nil {
+			return 0, nil, err
+		}
+
+		op, payload = c.messageOpcode, c.message
+		c.fragmenting = false
+		c.fragments = 0
+		// バッファは次のメッセージでも再利用する
+		// ただし大きなメッセージを受信した後は、使わないメモリを保持し続けないよう手放す
+		if cap(c.message) > maxRetainedMessageBuffer {
+			c.message = nil
+		} else {
+			c.message = c.message[:0]
+		}
+		return op, payload, nil
 	}
 }
 
-func readFrame(r *bufio.ReadWriter) (opcode byte, payload []byte, err error) {
-	// 各データフレームは以下の形式で構成されている
-	// see https://www.rfc-editor.org/rfc/rfc6455#section-5.2
-	/*
-			     0                   1                   2                   3
-		         0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1
-		        +-+-+-+-+-------+-+-------------+-------------------------------+
-		        |F|R|R|R| opcode|M| Payload len |    Extended payload length    |
-		        |I|S|S|S|  (4)  |A|     (7)     |             (16/64)           |
-		        |N|V|V|V|       |S|             |   (if payload len==126/127)   |
-		        | |1|2|3|       |K|             |                               |
-		        +-+-+-+-+-------+-+-------------+ - - - - - - - - - - - - - - - +
-		        |     Extended payload length continued, if payload len == 127  |
-		        + - - - - - - - - - - - - - - - +-------------------------------+
-		        |                               |Masking-key, if MASK set to 1  |
-		        +-------------------------------+-------------------------------+
-		        | Masking-key (continued)       |          Payload Data         |
-		        +-------------------------------- - - - - - - - - - - - - - - - +
-		        :                     Payload Data continued ...                :
-		        + - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - +
-		        |                     Payload Data continued ...                |
-		        +---------------------------------------------------------------+
-	*/
+// run はコネクションが終わるまでメッセージを読み込み、受信したメッセージごとにonMessageを呼ぶ
+// readMessageのループを自分で書く代わりに使う。制御フレームとcloseの処理はreadMessageと同じ(onMessageには渡さない)
+// onMessageに渡すpayloadは、onMessageから戻るまでの間だけ有効
+//
+// 受信したフレームに問題があった場合(*frameError)は、closeフレームで理由を伝えてからそのエラーを返す
+// onMessageがエラーを返した場合は、それ以上読み込まずにそのエラーを返す(closeするかは呼び出し元が決める)
+// 相手からcloseフレームを受信した場合は*closeErrorを返す
+func (c *conn) run(onMessage func(op opcode, payload []byte) error) error {
+	for {
+		op, payload, err := c.readMessage()
+		if err != nil {
+			var fe *frameError
+			if errors.As(err, &fe) {
+				if err := c.closeWithError(fe); err != nil {
+					fmt.Println("close error:", err)
+				}
+			}
+			return err
+		}
+		if err := onMessage(op, payload); err != nil {
+			return err
+		}
+	}
+}
 
-	const (
-		finBit    = 1 << 7
-		maskedBit = 1 << 7
-	)
+// limitRate は受信したメッセージをrateLimiterに数え、上限を超えていれば切断するか、トークンが補充されるまで待つ
+// 制御フレームは数えない(pingに答えられなくなると、相手からは接続が切れたように見えるため)
+func (c *conn) limitRate() error {
+	if c.rateLimiter == nil {
+		return nil
+	}
+	now := time.Now()
+	if !c.rateLimitBlock {
+		if !c.rateLimiter.allow(now) {
+			return &frameError{code: 1008, reason: "message rate limit exceeded"}
+		}
+		return nil
+	}
 
-	// 必須の先頭2バイトを読む
-	header := make([]byte, 2)
-	if _, err = io.ReadFull(r, header); err != nil {
-		return
+	d := c.rateLimiter.wait(now)
+	if d <= 0 {
+		return nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-c.ctx.Done():
+		return net.ErrClosed
+	}
+}
+
+// handleClose は受信したcloseフレームに対してcloseフレームを返信し、受信内容を*closeErrorとして返す
+// see https://www.rfc-editor.org/rfc/rfc6455#section-5.5.1
+func (c *conn) handleClose(payload []byte) error {
+	ce := &closeError{code: 1005}
+	// 返信には受信したステータスコードをそのまま使う
+	// ステータスコードがなかった場合は、ペイロードのないcloseフレームを返す
+	replyCode := 0
+	switch {
+	case len(payload) == 1:
+		// ステータスコードは2バイトなので、1バイトだけのペイロードは不正
+		return &frameError{code: 1002, reason: "invalid close frame payload"}
+	case len(payload) >= 2:
+		ce.code = int(payload[0])<<8 | int(payload[1])
+		// 理由はUTF-8でなければならない
+		if !utf8.Valid(payload[2:]) {
+			return &frameError{code: 1007, reason: "invalid UTF-8 in close reason"}
+		}
+		ce.text = string(payload[2:])
+
+		// 送信してはいけないステータスコードを受信した場合は、strictModeではプロトコル違反として扱い、
+		// そうでなければ警告したうえで1000を返す
+		replyCode = ce.code
+		if !isValidCloseCode(ce.code) {
+			if c.strictMode {
+				return &frameError{code: 1002, reason: "invalid close code"}
+			}
+			c.warn(fmt.Errorf("%w: %d", errInvalidCloseCode, ce.code))
+			replyCode = 1000
+		}
+	}
+
+	var err error
+	if replyCode == 0 {
+		err = c.writeControl(opClose, nil, time.Now().Add(controlWriteTimeout))
+	} else {
+		err = c.writeCloseFrame(replyCode, "")
+	}
+	if err != nil {
+		return err
+	}
+	return ce
+}
+
+var (
+	errUnsolicitedPong       = errors.New("received unsolicited pong")
+	errCloseTimeout          = errors.New("peer did not respond to close frame")
+	errInvalidCloseCode      = errors.New("received invalid close code")
+	errConnClosed            = errors.New("connection closed")
+	errSubprotocolNotOffered = errors.New("selected subprotocol was not offered")
+)
+
+// isValidCloseCode はcloseフレームで送ってよいステータスコードかどうかを返す
+// 1005, 1006, 1015は「ステータスコードがなかった」などを表すためにアプリケーション内部で使うもので、フレームで送ってはいけない
+// see https://www.rfc-editor.org/rfc/rfc6455#section-7.4
+func isValidCloseCode(code int) bool {
+	switch {
+	case code >= 1000 && code <= 1003:
+		return true
+	case code >= 1007 && code <= 1014:
+		return true
+	case code >= 3000 && code <= 4999:
+		return true
+	}
+	return false
+}
+
+// warn は接続を終了するほどではない異常をerrorHandlerに通知する
+func (c *conn) warn(err error) {
+	if c.errorHandler != nil {
+		c.errorHandler(err)
 	}
+}
+
+// closeError は相手からcloseフレームを受信したことを表すエラー
+type closeError struct {
+	code int    // 受信したステータスコード(ステータスコードがなかった場合は1005)
+	text string // 受信した理由
+}
+
+func (e *closeError) Error() string {
+	if e.text == "" {
+		return fmt.Sprintf("close %d (%s)", e.code, closeCodeText(e.code))
+	}
+	return fmt.Sprintf("close %d (%s): %s", e.code, closeCodeText(e.code), e.text)
+}
+
+// closeCodeText はcloseフレームのステータスコードの意味を返す
+// see https://www.rfc-editor.org/rfc/rfc6455#section-7.4
+func closeCodeText(code int) string {
+	switch code {
+	case 1000:
+		return "normal closure"
+	case 1001:
+		return "going away"
+	case 1002:
+		return "protocol error"
+	case 1003:
+		return "unsupported data"
+	case 1005:
+		return "no status received"
+	case 1006:
+		return "abnormal closure"
+	case 1007:
+		return "invalid frame payload data"
+	case 1008:
+		return "policy violation"
+	case 1009:
+		return "message too big"
+	case 1010:
+		return "mandatory extension"
+	case 1011:
+		return "internal error"
+	case 1012:
+		return "service restart"
+	case 1013:
+		return "try again later"
+	case 1014:
+		return "bad gateway"
+	case 1015:
+		return "TLS handshake failure"
+	}
+
+	// 3000~3999はライブラリやフレームワーク向けにIANAに登録されたコード、4000~4999はアプリケーションが自由に使えるコード
+	switch {
+	case code >= 3000 && code <= 3999:
+		return "registered status code (library/framework)"
+	case code >= 4000 && code <= 4999:
+		return "private status code (application)"
+	default:
+		return "unknown status code"
+	}
+}
+
+// connStats は送受信したバイト数と、メッセージの組み立てに関する統計のスナップショット
+// 組み立ての統計は、メッセージサイズやフラグメント数の上限を決める際の参考にする
+type connStats struct {
+	bytesRead          int64 // 受信したバイト数(フレームのヘッダーを含む)
+	bytesWritten       int64 // 送信したバイト数(フレームのヘッダーを含む)
+	fragmentedMessages int64 // フラグメント化されていたメッセージの数
+	maxFragments       int64 // 1つのメッセージのフラグメント数の最大値
+	maxReassembledSize int64 // 組み立て後のメッセージサイズの最大値
+}
+
+// stats は現在の統計を返す
+// 値は読み込み側のgoroutineで更新されるが、他のgoroutineから呼び出してもよい
+func (c *conn) stats() connStats {
+	return connStats{
+		bytesRead:          c.bytesRead.Load(),
+		bytesWritten:       c.bytesWritten.Load(),
+		fragmentedMessages: c.fragmentedMessages.Load(),
+		maxFragments:       c.maxFragments.Load(),
+		maxReassembledSize: c.maxReassembledSize.Load(),
+	}
+}
 
-	fin := (header[0] & finBit) != 0
-	opcode = header[0] & 0x0F // 0x0F = 00001111
-	masked := (header[1] & maskedBit) != 0
-	payloadLen := int(header[1] & 0x7F) // 0x7F = 01111111
+// recordMessage は組み立てが完了したメッセージを統計に反映する
+// 更新するのは読み込み側のgoroutineだけなので、最大値の比較と書き込みの間に競合はない
+func (c *conn) recordMessage(fragments, size int) {
+	if fragments > 1 {
+		c.fragmentedMessages.Add(1)
+	}
+	if int64(fragments) > c.maxFragments.Load() {
+		c.maxFragments.Store(int64(fragments))
+	}
+	if int64(size) > c.maxReassembledSize.Load() {
+		c.maxReassembledSize.Store(int64(size))
+	}
+}
 
-	// opcodeは、0x0~0x7がテキストフレーム、0x8がcloseフレーム、0x9がpingフレーム、0xAがpongフレーム
-	// closeフレームを受信した場合は、ここで終了
-	if opcode == 0x8 {
+// setState はkeyにvalueを紐づける。valueがnilの場合はkeyの紐づけを削除する
+// 任意のgoroutineから呼び出してよい
+// 他のパッケージと衝突しないよう、keyには独自の型を使うとよい(context.WithValueのkeyと同様)
+func (c *conn) setState(key, value any) {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+	if value == nil {
+		delete(c.states, key)
 		return
 	}
+	if c.states == nil {
+		c.states = make(map[any]any)
+	}
+	c.states[key] = value
+}
 
-	if payloadLen == 126 {
-		ext := make([]byte, 2)
-		if _, err = io.ReadFull(r, ext); err != nil {
-			return
-		}
-		// example:
-		//   ext[0] = 00000001 = 1
-		//   ext[1] = 01111110 = 126
-		//   payloadLen = 1<<8 | 126 = 256 + 126 = 382
-		payloadLen = int(ext[0])<<8 | int(ext[1])
-	} else if payloadLen == 127 {
-		ext := make([]byte, 8)
-		if _, err = io.ReadFull(r, ext); err != nil {
-			return
+// state はkeyに紐づけられた値を返す(紐づけられていない場合はnil)
+// 任意のgoroutineから呼び出してよい
+func (c *conn) state(key any) any {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+	return c.states[key]
+}
+
+// readFrameHeader はフレームのヘッダーを読み込み、読み込んだバイト数をbytesReadに加える
+func (c *conn) readFrameHeader() (frameHeader, error) {
+	h, err := readFrameHeader(c.br)
+	if err != nil {
+		return h, err
+	}
+	c.bytesRead.Add(int64(h.headerLen))
+	return h, nil
+}
+
+// readFramePayload はフレームのペイロードをdstの末尾に読み込み、読み込んだバイト数をbytesReadに加える
+func (c *conn) readFramePayload(h frameHeader, dst []byte) ([]byte, error) {
+	n := len(dst)
+	dst, err := readFramePayload(c.br, h, dst)
+	if err != nil {
+		return nil, err
+	}
+	c.bytesRead.Add(int64(h.payloadLen))
+
+	if c.frameInterceptor != nil {
+		if err := c.frameInterceptor(frameRead, h, dst[n:]); err != nil {
+			return nil, &frameError{code: 1008, reason: "frame rejected", err: err}
 		}
-		// 一旦4GB超のデータは無視
-		payloadLen = int(ext[4])<<24 | int(ext[5])<<16 | int(ext[6])<<8 | int(ext[7])
 	}
+	return dst, nil
+}
 
-	var maskingKey []byte
-	if masked {
-		maskingKey = make([]byte, 4)
-		if _, err = io.ReadFull(r, maskingKey); err != nil {
-			return
+// discardFramePayload はフレームのペイロードをバッファに読み込まずに読み捨て、読み捨てたバイト数をbytesReadに加える
+func (c *conn) discardFramePayload(h frameHeader) error {
+	n, err := io.CopyN(io.Discard, c.br, int64(h.payloadLen))
+	c.bytesRead.Add(n)
+	return err
+}
+
+// interceptWrite は送信するフレームをframeInterceptorに渡す
+func (c *conn) interceptWrite(op opcode, payload []byte) error {
+	if c.frameInterceptor == nil {
+		return nil
+	}
+	h := frameHeader{
+		fin:        true,
+		opcode:     op,
+		payloadLen: len(payload),
+		headerLen:  frameHeaderLen(len(payload)),
+	}
+	return c.frameInterceptor(frameWrite, h, payload)
+}
+
+// writeFrame はデータフレームを書き込み、バッファをフラッシュする
+// writeTimeoutが設定されている場合は、書き込みのたびにデッドラインを設定する
+func (c *conn) writeFrame(op opcode, payload []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	var deadline time.Time
+	if c.writeTimeout > 0 {
+		deadline = time.Now().Add(c.writeTimeout)
+	}
+	return c.writeDataFrame(op, payload, deadline)
+}
+
+// writeMessageTimeout はwriteTimeoutの代わりにdをタイムアウトとしてデータフレームを書き込む
+// dまでに書き込めなかった場合は、Timeout()がtrueのnet.Errorを返す(そのコネクションにはもう書き込めない)
+// 書き終えたらデッドラインを解除するので、後の書き込みには影響しない
+// 途中でpingなどの制御フレームを書き込む場合も、writeMuで直列化されるので、このデッドラインが制御フレームに使われることはない
+func (c *conn) writeMessageTimeout(op opcode, payload []byte, d time.Duration) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	defer func() {
+		if !c.writeDeadline.IsZero() {
+			c.writeDeadline = time.Time{}
+			c.setWriteDeadline(c.writeDeadline)
+		}
+	}()
+	return c.writeDataFrame(op, payload, time.Now().Add(d))
+}
+
+// message はwriteMessagesでまとめて送信するメッセージ
+type message struct {
+	op      opcode
+	payload []byte
+}
+
+// writeMessages はmsgsを、間に他のフレーム(pingやpongなど)を挟まずに続けて書き込み、最後に一度だけフラッシュする
+// スナップショットの後に差分を送る場合など、メッセージの並びを崩したくない場合に使う
+// 書き込みの間はwriteMuを持ち続けるので、その間は制御フレームの送信も待たされる
+// pongやcloseの返信が遅れないよう、大量のメッセージや大きなメッセージをまとめて送るのには使わない
+//
+// 一部のメッセージだけを送ることにならないよう、frameInterceptorには書き込む前にすべてのメッセージを渡す
+// writeTimeoutはメッセージごとではなく、全体に対して適用する
+func (c *conn) writeMessages(msgs []message) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	if err := c.checkWritable(); err != nil {
+		return err
+	}
+	for _, m := range msgs {
+		if err := c.interceptWrite(m.op, m.payload); err != nil {
+			return err
 		}
 	}
 
-	payload = make([]byte, payloadLen)
-	if _, err = io.ReadFull(r, payload); err != nil {
-		return
+	if c.writeTimeout > 0 {
+		c.writeDeadline = time.Now().Add(c.writeTimeout)
+		if err := c.setWriteDeadline(c.writeDeadline); err != nil {
+			return err
+		}
 	}
 
-	if masked {
-		for i := range payloadLen {
-			payload[i] ^= maskingKey[i%4]
+	for _, m := range msgs {
+		if err := writeFrame(c.bw, m.op, m.payload); err != nil {
+			return c.writeFailed(err)
 		}
+		c.bytesWritten.Add(int64(frameHeaderLen(len(m.payload)) + len(m.payload)))
+	}
+	if err := c.bw.Flush(); err != nil {
+		return c.writeFailed(err)
+	}
+	return nil
+}
+
+// writeDataFrame はデータフレームを書き込む(writeMuを取った状態で呼ぶ)
+// deadlineがゼロでなければ、書き込む前にデータの書き込み用のデッドラインとして設定する
+func (c *conn) writeDataFrame(op opcode, payload []byte, deadline time.Time) error {
+	if err := c.checkWritable(); err != nil {
+		return err
+	}
+	if err := c.interceptWrite(op, payload); err != nil {
+		return err
 	}
 
-	if !fin {
-		// 一旦、フラグメント化されたフレームは無視
-		err = fmt.Errorf("fragmented frames not supported yet")
+	if !deadline.IsZero() {
+		c.writeDeadline = deadline
+		if err := c.setWriteDeadline(c.writeDeadline); err != nil {
+			return err
+		}
 	}
 
-	return
+	if err := writeFrame(c.bw, op, payload); err != nil {
+		return c.writeFailed(err)
+	}
+	c.bytesWritten.Add(int64(frameHeaderLen(len(payload)) + len(payload)))
+	if err := c.bw.Flush(); err != nil {
+		return c.writeFailed(err)
+	}
+	return nil
 }
 
-func writeCloseFrame(w io.Writer, code int, reason string) error {
-	payload := make([]byte, 2+len(reason))
-	payload[0] = byte(code >> 8)
-	payload[1] = byte(code)
+// writeControl は制御フレームをdeadlineまでに書き込む
+// データの書き込みに長いデッドラインが設定されていても、keepaliveのpingなどの制御フレームがそれを引き継いで
+// 長時間ブロックしないよう、書き込む間だけデッドラインを差し替え、終わったらデータの書き込み用のデッドラインに戻す
+func (c *conn) writeControl(op opcode, payload []byte, deadline time.Time) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	if err := c.checkWritable(); err != nil {
+		return err
+	}
+	if err := c.interceptWrite(op, payload); err != nil {
+		return err
+	}
 
-	copy(payload[2:], reason)
+	if err := c.setWriteDeadline(deadline); err != nil {
+		return err
+	}
+	defer c.setWriteDeadline(c.writeDeadline)
 
-	return writeFrame(w, 0x8, payload)
+	if err := writeFrame(c.bw, op, payload); err != nil {
+		return c.writeFailed(err)
+	}
+	c.bytesWritten.Add(int64(frameHeaderLen(len(payload)) + len(payload)))
+	if op == opClose {
+		c.closeSent = true
+	}
+	if err := c.bw.Flush(); err != nil {
+		return c.writeFailed(err)
+	}
+	return nil
 }
 
-func writeFrame(w io.Writer, opcode byte, payload []byte) error {
-	// 送信時はマスクしないため、Finとopcodeのみをセット
-	header := []byte{0x80 | opcode}
+// writeFailed は通信路への書き込みが失敗したときに呼び、ソケットを閉じてerrを返す
+// 書き込みの途中で失敗するとフレームの区切りがわからなくなり、bufio.Writerもエラーを保持し続けるので、このコネクションにはもう書き込めない
+// 読み込みのgoroutineがフレームを待ってブロックしたままにならないよう、ソケットを閉じて読み込みもエラーで終わらせる(コンテキストもキャンセルされる)
+// 書き込む前に検出したエラー(制御フレームのペイロードが大きすぎるなど)の場合は、まだ何も書き込んでいないので閉じない
+func (c *conn) writeFailed(err error) error {
+	if errors.Is(err, errControlFrameTooLarge) {
+		return err
+	}
+	c.closeTransport()
+	return err
+}
 
-	payloadLen := len(payload)
-	if payloadLen < 126 {
-		header = append(header, byte(payloadLen))
-	} else if payloadLen <= 0xFFFF {
-		header = append(header, 126, byte(payloadLen>>8), byte(payloadLen))
-	} else {
-		header = append(header, 127,
-			0, 0, 0, 0, // 上位32bit無視
-			byte(payloadLen>>24), byte(payloadLen>>16), byte(payloadLen>>8), byte(payloadLen))
+// checkWritable はまだフレームを書き込んでよいかを確認する(writeMuを取った状態で呼ぶ)
+// closeフレームを送った後はデータフレームを送ってはいけない
+// see https://www.rfc-editor.org/rfc/rfc6455#section-5.5.1
+// 相手のcloseに応答した後や、ソケットを閉じた後に書き込むと、相手からRSTが返ってくることもあるため、
+// 通信路に書き込まずにすぐ失敗させる。キューに溜まったメッセージを別のgoroutineで送っている場合などに起きる
+func (c *conn) checkWritable() error {
+	if c.closeSent {
+		return errConnClosed
+	}
+	select {
+	case <-c.ctx.Done():
+		return errConnClosed
+	default:
+		return nil
+	}
+}
+
+func (c *conn) writeCloseFrame(code int, reason string) error {
+	payload, err := formatCloseMessage(code, reason)
+	if err != nil {
+		return err
 	}
+	return c.writeControl(opClose, payload, time.Now().Add(controlWriteTimeout))
+}
+
+// close はこちらからcloseフレームを送り、相手のcloseフレームを待ってからソケットを閉じる
+// see https://www.rfc-editor.org/rfc/rfc6455#section-7.1.1
+//
+// closeフレームを送った直後にソケットを閉じると、受信バッファに未読のデータが残っていた場合に
+// 相手へTCPのRSTが送られ、相手がcloseフレーム(と理由)を受け取れないことがある
+// そのため、相手のcloseフレームが届くかcloseGracePeriodが経過するまでは受信したフレームを読み捨てる
+//
+// 書き込みはwriteMuで直列化され、フレームごとにフラッシュしているので、送信途中のフレームがバッファに残ることはない
+// 別のgoroutineが書き込み中の場合は、そのメッセージを送り終えてからcloseフレームを送る(待つ時間はwriteTimeoutで制限される)
+// closeフレームを送った後の書き込みは、通信路に書き込まずにerrConnClosedで失敗するので、呼び出し元で失敗したメッセージを把握できる
+func (c *conn) close(code int, reason string) error {
+	defer c.closeTransport()
 
-	if _, err := w.Write(header); err != nil {
+	if err := c.writeCloseFrame(code, reason); err != nil {
 		return err
 	}
-	if _, err := w.Write(payload); err != nil {
+
+	if c.closeGracePeriod <= 0 {
+		return nil
+	}
+	if err := c.setReadDeadline(time.Now().Add(c.closeGracePeriod)); err != nil {
 		return err
 	}
-	return nil
+	for {
+		h, err := c.readFrameHeader()
+		if err == nil {
+			// 読み捨てるフレームは宣言された長さが大きくてもバッファを確保せずに捨てる
+			// closeフレームのペイロードはreadFrameHeaderで125バイト以下であることを確認済み
+			if h.opcode == opClose {
+				_, err = c.readFramePayload(h, nil)
+			} else {
+				err = c.discardFramePayload(h)
+			}
+		}
+		if err != nil {
+			// 猶予期間の経過や相手による切断。いずれにしてもソケットを閉じて終了する
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				c.warn(errCloseTimeout)
+			}
+			return nil
+		}
+		if h.opcode == opClose {
+			return nil
+		}
+	}
+}
+
+// closeWithError はerrに応じたステータスコードと理由でcloseする
+//   - nil: 1000(normal closure)
+//   - *frameError: そのcodeとreason
+//   - *closeError: 相手からのcloseにはreadMessageの中で返信しているので、何もせずnilを返す
+//   - context.Canceled: 1001(going away)。サーバーの終了などでハンドラーの処理が打ち切られた場合
+//   - それ以外: 1011(internal error)で、errのメッセージを理由にする
+//
+// 理由は制御フレームに収まるよう切り詰め、UTF-8として不正なバイトは置き換える
+func (c *conn) closeWithError(err error) error {
+	code, reason := 1011, ""
+	var fe *frameError
+	var ce *closeError
+	switch {
+	case err == nil:
+		code = 1000
+	case errors.As(err, &fe):
+		code, reason = fe.code, fe.reason
+	case errors.As(err, &ce):
+		return nil
+	case errors.Is(err, context.Canceled):
+		code, reason = 1001, "going away"
+	default:
+		reason = err.Error()
+	}
+	return c.close(code, truncateCloseReason(reason))
+}
+
+// truncateCloseReason はreasonをcloseフレームに入る長さ(ステータスコードの2バイトを除いた123バイト)に切り詰める
+// マルチバイト文字の途中で切らないよう、文字の境界で切る
+func truncateCloseReason(reason string) string {
+	reason = strings.ToValidUTF8(reason, "\uFFFD")
+	const maxLen = maxControlFramePayload - 2
+	if len(reason) <= maxLen {
+		return reason
+	}
+	n := maxLen
+	for n > 0 && !utf8.RuneStart(reason[n]) {
+		n--
+	}
+	return reason[:n]
 }
 
 func main() {
-	http.HandleFunc("/ws", websocketHandler)
-	fmt.Println("Server started at :8080")
-	http.ListenAndServe(":8080", nil)
+	addr := flag.String("addr", ":8080", "listen address")
+	certFile := flag.String("cert", "", "TLS certificate file (serve wss:// when set with -key)")
+	keyFile := flag.String("key", "", "TLS private key file")
+	strictMode := flag.Bool("strict", false, "also fail on deviations the spec forbids senders but does not require receivers to fail on (e.g. invalid close codes)")
+	trustProxyHeaders := flag.Bool("trust-proxy-headers", false, "use Forwarded/X-Forwarded-Proto to determine the client's scheme (enable only behind a trusted proxy)")
+	flag.Parse()
+
+	s := &server{
+		readBufferSize:   defaultReadBufferSize,
+		writeBufferSize:  defaultWriteBufferSize,
+		closeGracePeriod: defaultCloseGracePeriod,
+		maxMessageSize:   defaultMaxMessageSize,
+		maxConnections:   defaultMaxConnections,
+		pingInterval:     defaultPingInterval,
+		pongTimeout:      defaultPongTimeout,
+		maxPendingPings:  defaultMaxPendingPings,
+		errorHandler: func(err error) {
+			fmt.Println("warning:", err)
+		},
+		strictMode:        *strictMode,
+		trustProxyHeaders: *trustProxyHeaders,
+	}
+	http.Handle("/ws", newHandler(s, echo))
+
+	if *certFile != "" && *keyFile != "" {
+		hs, err := newTLSServer(*addr, nil, *certFile, *keyFile)
+		if err != nil {
+			fmt.Println("TLS config error:", err)
+			return
+		}
+		fmt.Println("Server started at", *addr, "(TLS)")
+		hs.ListenAndServeTLS("", "")
+		return
+	}
+
+	fmt.Println("Server started at", *addr)
+	http.ListenAndServe(*addr, nil)
 }
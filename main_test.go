@@ -0,0 +1,355 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testHandshakeRequest はクライアントが送るハンドシェイクのリクエスト
+// Sec-WebSocket-KeyはRFC 6455の例と同じ値を使う
+const testHandshakeRequest = "GET /ws HTTP/1.1\r\n" +
+	"Host: example.com\r\n" +
+	"Upgrade: websocket\r\n" +
+	"Connection: Upgrade\r\n" +
+	"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n" +
+	"Sec-WebSocket-Version: 13\r\n" +
+	"\r\n"
+
+// handshakeRequest はtestHandshakeRequestにheaderの行("Name: value")を加えたリクエストを返す
+func handshakeRequest(header ...string) []byte {
+	req := strings.TrimSuffix(testHandshakeRequest, "\r\n")
+	for _, h := range header {
+		req += h + "\r\n"
+	}
+	return []byte(req + "\r\n")
+}
+
+// newTestServer はsの設定でアップグレードしたコネクションをfnで処理する、テスト用のHTTPサーバーを起動する
+func newTestServer(t *testing.T, s *server, fn func(c *conn)) *httptest.Server {
+	t.Helper()
+	ts := httptest.NewServer(newHandler(s, fn))
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+// sendHandshake はtsに接続し、ハンドシェイクのリクエストとextraを1回の書き込みで送ってレスポンスを読む
+// reqがnilの場合はtestHandshakeRequestを送る
+// レスポンスの後に続くフレームを読めるよう、bufio.Readerも一緒に返す
+func sendHandshake(t *testing.T, ts *httptest.Server, req []byte, extra ...[]byte) (*http.Response, net.Conn, *bufio.Reader) {
+	t.Helper()
+	nc, err := net.Dial("tcp", ts.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { nc.Close() })
+	nc.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if req == nil {
+		req = []byte(testHandshakeRequest)
+	}
+	req = bytes.Clone(req)
+	for _, b := range extra {
+		req = append(req, b...)
+	}
+	if _, err := nc.Write(req); err != nil {
+		t.Fatalf("write handshake: %v", err)
+	}
+
+	br := bufio.NewReader(nc)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatalf("read handshake response: %v", err)
+	}
+	return resp, nc, br
+}
+
+// dialTestServer はsendHandshakeでハンドシェイクを行い、101が返ったことを確認する
+func dialTestServer(t *testing.T, ts *httptest.Server, extra ...[]byte) (net.Conn, *bufio.Reader) {
+	t.Helper()
+	resp, nc, br := sendHandshake(t, ts, nil, extra...)
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("handshake status = %d, want 101", resp.StatusCode)
+	}
+	return nc, br
+}
+
+// Autobahn Testsuiteのうち、-strictで起動したサーバーが通るべき代表的なケースを再現する
+func TestStrictServerConformance(t *testing.T) {
+	ts := newTestServer(t, &server{strictMode: true}, echo)
+
+	t.Run("2.7 unsolicited pong", func(t *testing.T) {
+		_, br := dialTestServer(t, ts,
+			clientFrame(true, opPong, nil),
+			clientFrame(true, opText, []byte("hello")),
+		)
+		f, err := readServerFrame(br)
+		if err != nil || f.opcode != opText || string(f.payload) != "hello" {
+			t.Fatalf("got %+v, %v; want text echo \"hello\"", f, err)
+		}
+	})
+
+	t.Run("6.3.1 invalid UTF-8", func(t *testing.T) {
+		// "κόσμε"の途中に不正なバイトを挟んだテキスト
+		payload := []byte("\xce\xba\xe1\xbd\xb9\xcf\x83\xce\xbc\xce\xb5\xed\xa0\x80\x65\x64\x69\x74\x65\x64")
+		_, br := dialTestServer(t, ts, clientFrame(true, opText, payload))
+		f, err := readServerFrame(br)
+		if err != nil || f.opcode != opClose || f.closeCode() != 1007 {
+			t.Fatalf("got %+v, %v; want close 1007", f, err)
+		}
+	})
+
+	t.Run("7.9.1 invalid close code", func(t *testing.T) {
+		_, br := dialTestServer(t, ts, clientClose(0, ""))
+		f, err := readServerFrame(br)
+		if err != nil || f.opcode != opClose || f.closeCode() != 1002 {
+			t.Fatalf("got %+v, %v; want close 1002", f, err)
+		}
+	})
+}
+
+// クライアントがハンドシェイクのレスポンスを待たずに最初のフレームを送った場合も、
+// Hijackの時点でHTTPサーバーのバッファに読み込まれているフレームを取りこぼさずに処理する
+func TestFrameSentWithHandshake(t *testing.T) {
+	ts := newTestServer(t, &server{}, echo)
+	_, br := dialTestServer(t, ts, clientFrame(true, opText, []byte("early")))
+	f, err := readServerFrame(br)
+	if err != nil || f.opcode != opText || string(f.payload) != "early" {
+		t.Fatalf("got %+v, %v; want text echo \"early\"", f, err)
+	}
+}
+
+// pongを返さない相手には、応答のないpingがmaxPendingPingsに達した後、1011のcloseフレームを送って切断する
+// デフォルトの設定と同じ比率の間隔で、pongTimeoutによる読み込みのタイムアウトより先に切断されることを確認する
+func TestHeartbeatNeverPong(t *testing.T) {
+	const scale = 100
+	ts := newTestServer(t, &server{
+		pingInterval:    defaultPingInterval / scale,
+		pongTimeout:     defaultPongTimeout / scale,
+		maxPendingPings: defaultMaxPendingPings,
+	}, echo)
+	_, br := dialTestServer(t, ts)
+
+	for i := range defaultMaxPendingPings {
+		f, err := readServerFrame(br)
+		if err != nil || f.opcode != opPing {
+			t.Fatalf("frame %d = %+v, %v; want ping", i, f, err)
+		}
+	}
+	f, err := readServerFrame(br)
+	if err != nil || f.opcode != opClose || f.closeCode() != 1011 || string(f.payload[2:]) != "ping timeout" {
+		t.Fatalf("got %+v, %v; want close 1011 \"ping timeout\"", f, err)
+	}
+}
+
+// closeフレームを受信した後のフレーム(2つ目のcloseやデータフレーム)は処理しない
+func TestFramesAfterCloseIgnored(t *testing.T) {
+	ts := newTestServer(t, &server{}, echo)
+	_, br := dialTestServer(t, ts,
+		clientClose(1000, ""),
+		clientClose(1000, ""),
+		clientFrame(true, opText, []byte("too late")),
+	)
+	f, err := readServerFrame(br)
+	if err != nil || f.opcode != opClose || f.closeCode() != 1000 {
+		t.Fatalf("got %+v, %v; want close 1000", f, err)
+	}
+	if f, err := readServerFrame(br); !errors.Is(err, io.EOF) {
+		t.Fatalf("after the close reply got %+v, %v; want EOF", f, err)
+	}
+}
+
+// ハンドラーがpanicした場合も、相手には1011のcloseフレームを送ってから切断する
+func TestHandlerPanicSendsInternalError(t *testing.T) {
+	ts := newTestServer(t, &server{}, func(c *conn) {
+		c.readMessage()
+		panic("boom")
+	})
+	_, br := dialTestServer(t, ts, clientFrame(true, opText, []byte("hi")))
+	f, err := readServerFrame(br)
+	if err != nil || f.opcode != opClose || f.closeCode() != 1011 {
+		t.Fatalf("got %+v, %v; want close 1011", f, err)
+	}
+}
+
+// 同時接続数がmaxConnectionsに達している場合は、アップグレードせずに503を返す
+func TestMaxConnections(t *testing.T) {
+	const limit = 2
+	s := &server{maxConnections: limit}
+	ts := newTestServer(t, s, echo)
+	var conns []net.Conn
+	for range limit {
+		nc, _ := dialTestServer(t, ts)
+		conns = append(conns, nc)
+	}
+
+	resp, _, _ := sendHandshake(t, ts, nil)
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("connection %d: status = %d, want 503", limit+1, resp.StatusCode)
+	}
+	if n := s.connections.Load(); n != limit {
+		t.Errorf("connections = %d after the rejection, want %d", n, limit)
+	}
+
+	// 切断されたコネクションの分は数から減らし、また接続できるようにする
+	conns[0].Close()
+	for deadline := time.Now().Add(time.Second); s.connections.Load() >= limit; {
+		if time.Now().After(deadline) {
+			t.Fatalf("connections = %d after a disconnect, want %d", s.connections.Load(), limit-1)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	dialTestServer(t, ts)
+}
+
+// サブプロトコルは提示されたものの中から選び、選ばれなかった場合はrequireSubprotocolMatchのときだけ403で拒否する
+func TestRequireSubprotocolMatch(t *testing.T) {
+	// "chat"にだけ対応している
+	selectChat := func(r *http.Request, offered []string) string {
+		if slices.Contains(offered, "chat") {
+			return "chat"
+		}
+		return ""
+	}
+	tests := []struct {
+		name       string
+		require    bool
+		offered    string // 空文字の場合はSec-WebSocket-Protocolを送らない
+		wantStatus int
+		wantProto  string
+	}{
+		{"match", false, "superchat, chat", http.StatusSwitchingProtocols, "chat"},
+		{"match required", true, "superchat, chat", http.StatusSwitchingProtocols, "chat"},
+		{"no match", false, "superchat", http.StatusSwitchingProtocols, ""},
+		{"no match required", true, "superchat", http.StatusForbidden, ""},
+		{"none offered required", true, "", http.StatusSwitchingProtocols, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := newTestServer(t, &server{subprotocol: selectChat, requireSubprotocolMatch: tt.require}, echo)
+			var header []string
+			if tt.offered != "" {
+				header = append(header, "Sec-WebSocket-Protocol: "+tt.offered)
+			}
+			resp, _, _ := sendHandshake(t, ts, handshakeRequest(header...))
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+			if got := resp.Header.Get("Sec-WebSocket-Protocol"); got != tt.wantProto {
+				t.Errorf("Sec-WebSocket-Protocol = %q, want %q", got, tt.wantProto)
+			}
+		})
+	}
+}
+
+// 提示されていないサブプロトコルを決め打ちで返した場合、strictModeでなければ警告したうえでそのまま返し、
+// strictModeでは500で拒否する
+func TestForcedSubprotocol(t *testing.T) {
+	forceLegacy := func(r *http.Request, offered []string) string { return "legacy" }
+	for _, strict := range []bool{false, true} {
+		// errorHandlerはサーバーのgoroutineから呼ばれるので、チャネルで受け取る
+		warnings := make(chan error, 1)
+		ts := newTestServer(t, &server{
+			subprotocol:  forceLegacy,
+			strictMode:   strict,
+			errorHandler: func(err error) { warnings <- err },
+		}, echo)
+		resp, _, _ := sendHandshake(t, ts, handshakeRequest("Sec-WebSocket-Protocol: chat"))
+
+		if strict {
+			if resp.StatusCode != http.StatusInternalServerError {
+				t.Errorf("strict: status = %d, want 500", resp.StatusCode)
+			}
+			continue
+		}
+		if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Sec-WebSocket-Protocol") != "legacy" {
+			t.Errorf("lenient: status = %d, protocol = %q; want 101 with \"legacy\"",
+				resp.StatusCode, resp.Header.Get("Sec-WebSocket-Protocol"))
+		}
+		select {
+		case err := <-warnings:
+			if !errors.Is(err, errSubprotocolNotOffered) {
+				t.Errorf("lenient: warning = %v, want errSubprotocolNotOffered", err)
+			}
+		default:
+			t.Error("lenient: no warning for the subprotocol that was not offered")
+		}
+	}
+}
+
+// authenticateがエラーを返した場合は、アップグレードせずにauthenticateFailureStatus(0の場合は401)で拒否する
+func TestAuthenticate(t *testing.T) {
+	requireToken := func(r *http.Request) error {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			return errors.New("invalid token")
+		}
+		return nil
+	}
+	tests := []struct {
+		name          string
+		failureStatus int
+		header        []string
+		wantStatus    int
+	}{
+		{"valid token", 0, []string{"Authorization: Bearer secret"}, http.StatusSwitchingProtocols},
+		{"missing token", 0, nil, http.StatusUnauthorized},
+		{"wrong token", 0, []string{"Authorization: Bearer guess"}, http.StatusUnauthorized},
+		{"custom status", http.StatusNotFound, nil, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := newTestServer(t, &server{
+				authenticate:              requireToken,
+				authenticateFailureStatus: tt.failureStatus,
+			}, echo)
+			resp, _, _ := sendHandshake(t, ts, handshakeRequest(tt.header...))
+			if resp.StatusCode != tt.wantStatus {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+		})
+	}
+}
+
+// ハンドラーはアップグレード後もc.requestからハンドシェイクのパスやヘッダーを参照できる
+func TestRequestInfo(t *testing.T) {
+	got := make(chan requestInfo, 1)
+	ts := newTestServer(t, &server{}, func(c *conn) { got <- c.request })
+
+	req := bytes.Replace(handshakeRequest("X-User: alice"), []byte("GET /ws "), []byte("GET /rooms/42?lang=ja "), 1)
+	resp, nc, _ := sendHandshake(t, ts, req)
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("status = %d, want 101", resp.StatusCode)
+	}
+
+	info := <-got
+	if info.url.Path != "/rooms/42" || info.url.Query().Get("lang") != "ja" {
+		t.Errorf("url = %v, want /rooms/42?lang=ja", info.url)
+	}
+	if info.header.Get("X-User") != "alice" {
+		t.Errorf("X-User = %q, want \"alice\"", info.header.Get("X-User"))
+	}
+	if info.remoteAddr != nc.LocalAddr().String() {
+		t.Errorf("remoteAddr = %q, want %q", info.remoteAddr, nc.LocalAddr())
+	}
+}
+
+// newRequestInfoはURLとヘッダーを複製するので、元のリクエストを変更しても影響を受けない
+func TestNewRequestInfoCopies(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "http://example.com/ws", nil)
+	r.Header.Set("X-User", "alice")
+	info := newRequestInfo(r)
+
+	r.URL.Path = "/changed"
+	r.Header.Set("X-User", "mallory")
+	if info.url.Path != "/ws" || info.header.Get("X-User") != "alice" {
+		t.Errorf("requestInfo = %v %v, want the values at upgrade time", info.url, info.header)
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// checkSameOrigin はOriginヘッダーのスキームとホストがリクエスト先と一致するか確認する
+// 他のサイトのページからブラウザ経由で接続されるのを防ぐ(Cross-Site WebSocket Hijacking対策)
+// Originヘッダーはブラウザが付けるものなので、ない場合はブラウザ以外のクライアントとみなして許可する
+//
+// trustProxyHeadersがtrueの場合は、TLSを終端するリバースプロキシが付けたForwarded/X-Forwarded-Protoから
+// クライアントが実際に使ったスキームを判定する
+// これらのヘッダーはクライアントが自由に付けられるので、プロキシを経由しないと到達できない場合のみ有効にする
+func checkSameOrigin(r *http.Request, trustProxyHeaders bool) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+
+	// Originはhttp/httpsのスキームなので、リクエストのスキームも同じ形で比べる
+	return strings.EqualFold(u.Scheme, requestScheme(r, trustProxyHeaders)) && strings.EqualFold(u.Host, r.Host)
+}
+
+// requestScheme はクライアントがリクエストに使ったスキーム(httpまたはhttps)を返す
+func requestScheme(r *http.Request, trustProxyHeaders bool) string {
+	if trustProxyHeaders {
+		if proto := forwardedProto(r.Header); proto != "" {
+			return strings.ToLower(proto)
+		}
+	}
+	if r.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// forwardedProto はForwardedヘッダー(RFC 7239)のprotoパラメーター、なければX-Forwarded-Protoの値を返す
+// プロキシが複数段ある場合は、クライアントに最も近いプロキシが付けた先頭の値を使う
+//
+// example:
+//
+//	Forwarded: for=192.0.2.60;proto=https;by=203.0.113.43, for=198.51.100.17
+//	X-Forwarded-Proto: https
+func forwardedProto(h http.Header) string {
+	if v := h.Get("Forwarded"); v != "" {
+		first, _, _ := strings.Cut(v, ",")
+		for _, pair := range strings.Split(first, ";") {
+			key, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+			if ok && strings.EqualFold(key, "proto") {
+				return strings.Trim(value, `"`)
+			}
+		}
+	}
+	if v := h.Get("X-Forwarded-Proto"); v != "" {
+		first, _, _ := strings.Cut(v, ",")
+		return strings.TrimSpace(first)
+	}
+	return ""
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCheckSameOrigin(t *testing.T) {
+	tests := []struct {
+		name              string
+		origin            string
+		header            map[string]string
+		trustProxyHeaders bool
+		want              bool
+	}{
+		{"no origin", "", nil, false, true},
+		{"same origin", "http://example.com", nil, false, true},
+		{"case-insensitive", "HTTP://Example.COM", nil, false, true},
+		{"other host", "http://evil.example", nil, false, false},
+		{"other scheme", "https://example.com", nil, false, false},
+		{"invalid origin", "http://[::1", nil, false, false},
+
+		// TLSを終端するプロキシの後ろでは、サーバーが受けるリクエストはhttpになる
+		{"x-forwarded-proto trusted", "https://example.com", map[string]string{"X-Forwarded-Proto": "https"}, true, true},
+		{"x-forwarded-proto untrusted", "https://example.com", map[string]string{"X-Forwarded-Proto": "https"}, false, false},
+		{"x-forwarded-proto first value", "https://example.com", map[string]string{"X-Forwarded-Proto": "https, http"}, true, true},
+		{"forwarded trusted", "https://example.com", map[string]string{"Forwarded": `for=192.0.2.60;proto="https";by=203.0.113.43`}, true, true},
+		{"forwarded untrusted", "https://example.com", map[string]string{"Forwarded": "proto=https"}, false, false},
+		{"forwarded first element", "https://example.com", map[string]string{"Forwarded": "for=192.0.2.60;proto=https, for=198.51.100.17;proto=http"}, true, true},
+		{
+			"forwarded before x-forwarded-proto",
+			"https://example.com",
+			map[string]string{"Forwarded": "proto=https", "X-Forwarded-Proto": "http"},
+			true,
+			true,
+		},
+		{"trusted without headers", "https://example.com", nil, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "http://example.com/ws", nil)
+			if tt.origin != "" {
+				r.Header.Set("Origin", tt.origin)
+			}
+			for k, v := range tt.header {
+				r.Header.Set(k, v)
+			}
+			if got := checkSameOrigin(r, tt.trustProxyHeaders); got != tt.want {
+				t.Errorf("checkSameOrigin() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// checkOriginが設定されていない場合は、別のオリジンからのハンドシェイクを403で拒否する
+func TestCrossOriginHandshakeRejected(t *testing.T) {
+	ts := newTestServer(t, &server{}, echo)
+	resp, _, _ := sendHandshake(t, ts, handshakeRequest("Origin: http://evil.example"))
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("status = %d, want 403", resp.StatusCode)
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import "time"
+
+// rateLimiter は受信メッセージ数を制限するトークンバケット
+// 1秒あたりrate個のトークンが補充され、バケットには最大でburst個まで貯まる
+// 1つのコネクションの読み込み側のgoroutineからのみ使うので、ロックは取らない
+type rateLimiter struct {
+	rate   float64 // 1秒あたりに補充されるトークン数
+	burst  float64 // バケットの容量
+	tokens float64 // 現在のトークン数(waitで先取りした場合は負になる)
+	last   time.Time
+}
+
+// newRateLimiter は1秒あたりrate個のメッセージを許可するrateLimiterを作る
+// 短い間に集中して届くことはよくあるので、1秒分(最低1個)までは貯めておけるようにする
+func newRateLimiter(rate float64) *rateLimiter {
+	burst := max(rate, 1)
+	return &rateLimiter{
+		rate:   rate,
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+	}
+}
+
+// refill は前回からの経過時間に応じてトークンを補充する
+func (l *rateLimiter) refill(now time.Time) {
+	l.tokens = min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+}
+
+// allow はトークンがあれば1つ消費してtrueを返す。なければ何も消費せずにfalseを返す
+func (l *rateLimiter) allow(now time.Time) bool {
+	l.refill(now)
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
+
+// wait はトークンを1つ消費し、そのトークンが補充されるまで待つべき時間を返す(すぐに使える場合は0)
+// トークンは先取りするので、待っている間に次のメッセージが届いてもさらに後ろに並ぶ
+func (l *rateLimiter) wait(now time.Time) time.Duration {
+	l.refill(now)
+	l.tokens--
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
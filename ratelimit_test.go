@@ -0,0 +1,81 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Now()
+	l := newRateLimiter(2)
+	l.last = now
+
+	// 1秒分(2個)までは続けて許可し、それ以降はトークンが補充されるまで拒否する
+	for i := range 2 {
+		if !l.allow(now) {
+			t.Fatalf("allow() #%d = false, want true", i+1)
+		}
+	}
+	if l.allow(now) {
+		t.Fatal("allow() after the burst = true, want false")
+	}
+	if !l.allow(now.Add(500 * time.Millisecond)) {
+		t.Fatal("allow() after refilling one token = false, want true")
+	}
+
+	// waitはトークンを先取りするので、トークンがなくなった後は続けて呼ぶほど待つ時間が長くなる
+	l = newRateLimiter(2)
+	l.last = now
+	for i, want := range []time.Duration{0, 0, 500 * time.Millisecond, time.Second} {
+		if d := l.wait(now); d != want {
+			t.Errorf("wait() #%d = %v, want %v", i+1, d, want)
+		}
+	}
+}
+
+// burst個のテキストメッセージを続けて送るconnを作る
+func newBurstConn(burst int, rate float64, block bool) *conn {
+	var frames [][]byte
+	for range burst {
+		frames = append(frames, clientFrame(true, opText, []byte("m")))
+	}
+	c, _ := newTestConn(frames...)
+	c.rateLimiter = newRateLimiter(rate)
+	c.rateLimitBlock = block
+	return c
+}
+
+func TestRateLimitBurst(t *testing.T) {
+	t.Run("close", func(t *testing.T) {
+		c := newBurstConn(8, 5, false)
+		var got int
+		err := c.run(func(opcode, []byte) error {
+			got++
+			return nil
+		})
+		var fe *frameError
+		if !errors.As(err, &fe) || fe.code != 1008 {
+			t.Fatalf("run() error = %v, want frameError 1008", err)
+		}
+		if got != 5 {
+			t.Errorf("delivered %d messages before the limit tripped, want 5", got)
+		}
+	})
+
+	t.Run("block", func(t *testing.T) {
+		// 20個までは続けて受け付け、残りの10個は1秒あたり20個の割合で受け付ける(約0.5秒)
+		c := newBurstConn(30, 20, true)
+		start := time.Now()
+		var got int
+		for range 30 {
+			if _, _, err := c.readMessage(); err != nil {
+				t.Fatalf("readMessage() #%d error = %v", got+1, err)
+			}
+			got++
+		}
+		if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+			t.Errorf("30 messages took %v, want them throttled to about 500ms", elapsed)
+		}
+	})
+}
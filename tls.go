@@ -0,0 +1,32 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+)
+
+// newTLSServer はwss://でWebSocketを提供するためのhttp.Serverを返す
+//
+// WebSocketのハンドシェイクはHTTP/1.1のUpgradeを使うため、ALPNでh2がネゴシエートされると
+// ResponseWriterがHijackに対応しておらずアップグレードできない
+// そのためALPNではhttp/1.1だけを提示し、サーバー側でもHTTP/2を無効にしておく
+func newTLSServer(addr string, handler http.Handler, certFile, keyFile string) (*http.Server, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	var protocols http.Protocols
+	protocols.SetHTTP1(true)
+
+	return &http.Server{
+		Addr:    addr,
+		Handler: handler,
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			NextProtos:   []string{"http/1.1"},
+			MinVersion:   tls.VersionTLS12,
+		},
+		Protocols: &protocols,
+	}, nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestCert は127.0.0.1用の自己署名証明書と秘密鍵をdirにPEMで書き出し、そのパスと証明書を返す
+func writeTestCert(t *testing.T, dir string) (certFile, keyFile string, cert *x509.Certificate) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "go-websocket test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err = x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile = filepath.Join(dir, "cert.pem")
+	keyFile = filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile, cert
+}
+
+// クライアントがh2も提示していても、ALPNでhttp/1.1が選ばれ、wss://のハンドシェイクとエコーができる
+func TestTLSHandshake(t *testing.T) {
+	certFile, keyFile, cert := writeTestCert(t, t.TempDir())
+	hs, err := newTLSServer("127.0.0.1:0", newHandler(&server{}, echo), certFile, keyFile)
+	if err != nil {
+		t.Fatalf("newTLSServer() error = %v", err)
+	}
+	ts := httptest.NewUnstartedServer(hs.Handler)
+	ts.Config = hs
+	ts.TLS = hs.TLSConfig
+	ts.StartTLS()
+	defer ts.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	tc, err := tls.Dial("tcp", ts.Listener.Addr().String(), &tls.Config{
+		RootCAs:    roots,
+		NextProtos: []string{"h2", "http/1.1"},
+	})
+	if err != nil {
+		t.Fatalf("tls.Dial() error = %v", err)
+	}
+	defer tc.Close()
+	tc.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if p := tc.ConnectionState().NegotiatedProtocol; p != "http/1.1" {
+		t.Fatalf("negotiated protocol = %q, want \"http/1.1\"", p)
+	}
+
+	if _, err := tc.Write(append(handshakeRequest(), clientFrame(true, opText, []byte("secure"))...)); err != nil {
+		t.Fatalf("write handshake: %v", err)
+	}
+	br := bufio.NewReader(tc)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil || resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("handshake response = %v, %v; want 101", resp, err)
+	}
+	f, err := readServerFrame(br)
+	if err != nil || f.opcode != opText || string(f.payload) != "secure" {
+		t.Fatalf("got %+v, %v; want text echo \"secure\"", f, err)
+	}
+}